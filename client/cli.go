@@ -0,0 +1,334 @@
+package client
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/modcloth-labs/rtot/server"
+)
+
+// cliCommand adds a subcommand's flags and returns what to run once
+// they've been parsed
+type cliCommand func(fl *flag.FlagSet) func(c *Client, args []string) int
+
+var cliCommands = map[string]cliCommand{
+	"run":  cliRun,
+	"ls":   cliList,
+	"logs": cliLogs,
+	"rm":   cliRemove,
+	"kill": cliKill,
+}
+
+// IsCommand is true when name is one of the CLI's subcommands rather
+// than something for the server
+func IsCommand(name string) bool {
+	_, ok := cliCommands[name]
+	return ok
+}
+
+// CLIMain is the entry point for the CLI subcommands, with args starting
+// at the subcommand's name
+func CLIMain(args []string) int {
+	cmd, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "rtot: unknown command %q\n", args[0])
+		return 2
+	}
+
+	host := os.Getenv("RTOT_HOST")
+	if host == "" {
+		host = "localhost:8457"
+	}
+
+	fl := flag.NewFlagSet("rtot "+args[0], flag.ExitOnError)
+	fl.StringVar(&host, "H", host, "rtot server [RTOT_HOST]")
+	secret := fl.String("s", os.Getenv("RTOT_SECRET"), "Secret or API token [RTOT_SECRET]")
+	group := fl.String("g", os.Getenv("RTOT_GROUP"), "Job group [RTOT_GROUP]")
+	sign := fl.Bool("hmac", os.Getenv("RTOT_HMAC") == "true",
+		"Sign requests rather than sending the secret [RTOT_HMAC]")
+	tokenName := fl.String("token-name", os.Getenv("RTOT_TOKEN_NAME"),
+		"Name of the API token given with -s, for signing [RTOT_TOKEN_NAME]")
+	cert := fl.String("cert", os.Getenv("RTOT_CLIENT_CERT"),
+		"TLS client certificate file [RTOT_CLIENT_CERT]")
+	key := fl.String("key", os.Getenv("RTOT_CLIENT_KEY"), "TLS client key file [RTOT_CLIENT_KEY]")
+	ca := fl.String("ca", os.Getenv("RTOT_CA"),
+		"CA bundle for verifying the server, using https [RTOT_CA]")
+	run := cmd(fl)
+
+	positional := parseInterspersed(fl, args[1:])
+
+	useTLS := *cert != "" || *ca != ""
+	if useTLS && !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+
+	c := New(host, *secret)
+	c.Group = *group
+	c.Sign = *sign
+	c.TokenName = *tokenName
+	if useTLS {
+		if err := c.UseTLS(*cert, *key, *ca); err != nil {
+			fmt.Fprintf(os.Stderr, "rtot: %v\n", err)
+			return 1
+		}
+	}
+	return run(c, positional)
+}
+
+// parseInterspersed parses flags that come after positional arguments
+// too, as in "rtot run script.sh -wait", returning the positional ones.
+// Everything after "--" is positional.
+func parseInterspersed(fl *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		fl.Parse(args)
+		rest := fl.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// envFlag collects repeated KEY=value flags
+type envFlag map[string]string
+
+func (e envFlag) String() string {
+	return fmt.Sprintf("%v", map[string]string(e))
+}
+
+func (e envFlag) Set(pair string) error {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected KEY=value, got %q", pair)
+	}
+	e[parts[0]] = parts[1]
+	return nil
+}
+
+// cliRun submits a script, read from stdin when none is named, and with
+// -wait streams its output and exits with its exit code
+func cliRun(fl *flag.FlagSet) func(c *Client, args []string) int {
+	jr := &JobRequest{Env: map[string]string{}, Params: map[string]string{}}
+	wait := fl.Bool("wait", false, "Wait for the job, exiting with its exit code")
+	command := fl.String("c", "", "Run this catalog command instead of a script")
+	fl.Var(envFlag(jr.Env), "e", "Environment variable KEY=value, repeatable")
+	fl.Var(envFlag(jr.Params), "p", "Command param name=value, repeatable")
+	fl.StringVar(&jr.Dir, "dir", "", "Working directory")
+	fl.StringVar(&jr.Timeout, "timeout", "", "Job timeout")
+	fl.IntVar(&jr.Priority, "priority", 0, "Job priority")
+	fl.StringVar(&jr.Delay, "delay", "", "Wait this long before running the job")
+	fl.StringVar(&jr.RunAt, "at", "", "Run the job at this RFC 3339 time")
+	stdin := fl.String("stdin", "", "File to feed the job on stdin")
+	retry := fl.Int("retry", 0, "Run the job up to this many times until it succeeds")
+
+	return func(c *Client, args []string) int {
+		var (
+			j   *server.JobJSON
+			err error
+		)
+
+		if *stdin != "" {
+			stdinBytes, err := ioutil.ReadFile(*stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "rtot: %v\n", err)
+				return 1
+			}
+			jr.Stdin = string(stdinBytes)
+		}
+
+		if *retry > 0 {
+			jr.Retry = &server.RetryPolicy{MaxAttempts: *retry}
+		}
+
+		if *command != "" {
+			j, err = c.Run(*command, jr)
+		} else {
+			jr.Script, err = readScript(args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "rtot: %v\n", err)
+				return 1
+			}
+			j, err = c.Create(jr)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rtot: %v\n", err)
+			return 1
+		}
+
+		if !*wait {
+			fmt.Println(j.ID)
+			return 0
+		}
+
+		var wg sync.WaitGroup
+		for stream, w := range map[string]io.Writer{"out": os.Stdout, "err": os.Stderr} {
+			wg.Add(1)
+			go func(stream string, w io.Writer) {
+				defer wg.Done()
+				c.Stream(j.ID, stream, 0, w)
+			}(stream, w)
+		}
+		wg.Wait()
+
+		j, err = c.Wait(j.ID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rtot: %v\n", err)
+			return 1
+		}
+		return exitCode(j)
+	}
+}
+
+func readScript(args []string) (string, error) {
+	if len(args) == 0 || args[0] == "-" {
+		scriptBytes, err := ioutil.ReadAll(os.Stdin)
+		return string(scriptBytes), err
+	}
+	scriptBytes, err := ioutil.ReadFile(args[0])
+	return string(scriptBytes), err
+}
+
+// exitCode is the job's exit code, or 1 when it didn't exit normally
+func exitCode(j *server.JobJSON) int {
+	if j.ExitCode != nil {
+		return *j.ExitCode
+	}
+	if j.Success != nil && *j.Success {
+		return 0
+	}
+	return 1
+}
+
+func cliList(fl *flag.FlagSet) func(c *Client, args []string) int {
+	state := fl.String("state", "", "Only list jobs in this state")
+
+	return func(c *Client, args []string) int {
+		jobs, err := c.List(*state)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rtot: %v\n", err)
+			return 1
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATE\tEXIT\tELAPSED\tCREATED\tCOMMAND")
+		for _, j := range jobs {
+			exit := ""
+			if j.ExitCode != nil {
+				exit = strconv.Itoa(*j.ExitCode)
+			} else if j.Signal != "" {
+				exit = j.Signal
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+				j.ID, j.State, exit, j.Elapsed, j.Create, j.Command)
+		}
+		w.Flush()
+		return 0
+	}
+}
+
+// cliLogs prints a job's output so far, or with -f follows its combined
+// log until it's done
+func cliLogs(fl *flag.FlagSet) func(c *Client, args []string) int {
+	follow := fl.Bool("f", false, "Follow output until the job is done")
+
+	return func(c *Client, args []string) int {
+		id, ok := jobIDArg(args)
+		if !ok {
+			return 2
+		}
+
+		if *follow {
+			err := c.Stream(id, "log", 0, os.Stdout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "rtot: %v\n", err)
+				return 1
+			}
+			return 0
+		}
+
+		j, err := c.Get(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rtot: %v\n", err)
+			return 1
+		}
+		fmt.Fprint(os.Stdout, j.Out)
+		fmt.Fprint(os.Stderr, j.Err)
+		return 0
+	}
+}
+
+func cliRemove(fl *flag.FlagSet) func(c *Client, args []string) int {
+	return func(c *Client, args []string) int {
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "rtot: expected job ids")
+			return 2
+		}
+
+		status := 0
+		for _, arg := range args {
+			id, ok := jobIDArg([]string{arg})
+			if !ok {
+				status = 2
+				continue
+			}
+			err := c.Delete(id)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "rtot: %v\n", err)
+				status = 1
+			}
+		}
+		return status
+	}
+}
+
+// cliKill signals jobs, KILL unless told otherwise, keeping them around
+func cliKill(fl *flag.FlagSet) func(c *Client, args []string) int {
+	signal := fl.String("signal", "KILL", "Signal to send, e.g. TERM, INT or HUP")
+
+	return func(c *Client, args []string) int {
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "rtot: expected job ids")
+			return 2
+		}
+
+		status := 0
+		for _, arg := range args {
+			id, ok := jobIDArg([]string{arg})
+			if !ok {
+				status = 2
+				continue
+			}
+			_, err := c.Signal(id, *signal)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "rtot: %v\n", err)
+				status = 1
+			}
+		}
+		return status
+	}
+}
+
+func jobIDArg(args []string) (int, bool) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "rtot: expected a job id")
+		return 0, false
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rtot: invalid job id %q\n", args[0])
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,358 @@
+// Package client talks to rtot servers
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/modcloth-labs/rtot/server"
+)
+
+// DefaultFields are the job fields asked for when none are given
+const DefaultFields = "out,err,create,start,complete,filename,dir,command,exit_code,signal,success"
+
+// Client is a connection to one rtot server, authenticating with either
+// the server's secret or an API token.  Jobs are created in and looked
+// up from the main job group unless Group is set.
+//
+// With Sign set, requests carry a signature made with Secret instead of
+// Secret itself, as servers run with -hmac-only need.  TokenName names
+// the API token Secret belongs to when it isn't the server's own secret.
+type Client struct {
+	BaseURL     string
+	Secret      string
+	Sign        bool
+	TokenName   string
+	Group       string
+	Fields      string
+	WaitTimeout time.Duration
+	HTTPClient  *http.Client
+}
+
+// JobRequest is the JSON envelope for creating a job
+type JobRequest struct {
+	Script   string            `json:"script"`
+	Env      map[string]string `json:"env,omitempty"`
+	CleanEnv bool              `json:"clean_env,omitempty"`
+	Dir      string            `json:"dir,omitempty"`
+	Timeout  string            `json:"timeout,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+	User     string            `json:"user,omitempty"`
+	Group    string            `json:"group,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+
+	Stdin     string `json:"stdin,omitempty"`
+	StdinOpen bool   `json:"stdin_open,omitempty"`
+
+	OutputMax int64 `json:"output_max,omitempty"`
+	Log       bool  `json:"log,omitempty"`
+
+	RunAt string `json:"run_at,omitempty"`
+	Delay string `json:"delay,omitempty"`
+
+	After []*server.JobDependency `json:"after,omitempty"`
+
+	Retry *server.RetryPolicy `json:"retry,omitempty"`
+}
+
+// Error is a response from the server that wasn't a success
+type Error struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v %v", e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// New makes a client for the server at baseURL, which defaults to http
+// when no scheme is given
+func New(baseURL, secret string) *Client {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	return &Client{
+		BaseURL:     strings.TrimRight(baseURL, "/"),
+		Secret:      secret,
+		Fields:      DefaultFields,
+		WaitTimeout: 30 * time.Second,
+		HTTPClient:  http.DefaultClient,
+	}
+}
+
+// UseTLS verifies the server's certificate against the CA bundle in
+// caFile rather than the system's, when given, and presents the client
+// certificate in certFile and keyFile, when given, for servers that
+// check client certificates
+func (c *Client) UseTLS(certFile, keyFile, caFile string) error {
+	config := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		caBytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return fmt.Errorf("no certificates found in %v", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	c.HTTPClient = &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config},
+	}
+	return nil
+}
+
+// Create submits a job, returning it as created
+func (c *Client) Create(jr *JobRequest) (*server.JobJSON, error) {
+	body, err := json.Marshal(jr)
+	if err != nil {
+		return nil, err
+	}
+	return c.one("POST", c.jobsPath(), "application/json", bytes.NewReader(body))
+}
+
+// CreateBatch submits several jobs at once, all of them or none,
+// returning them along with their batch id
+func (c *Client) CreateBatch(jrs []*JobRequest) ([]*server.JobJSON, int, error) {
+	body, err := json.Marshal(jrs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := c.do("POST", c.jobsPath()+"/batch", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Jobs, resp.Batch, nil
+}
+
+// Run submits a catalog command with the given params
+func (c *Client) Run(command string, jr *JobRequest) (*server.JobJSON, error) {
+	body, err := json.Marshal(jr)
+	if err != nil {
+		return nil, err
+	}
+	return c.one("POST", c.groupPath()+"/commands/"+url.QueryEscape(command),
+		"application/json", bytes.NewReader(body))
+}
+
+// Get looks up one job
+func (c *Client) Get(id int) (*server.JobJSON, error) {
+	return c.one("GET", c.jobPath(id), "", nil)
+}
+
+// List returns every job in the given state, or all of them when state
+// is empty
+func (c *Client) List(state string) ([]*server.JobJSON, error) {
+	path := c.jobsPath()
+	if state != "" {
+		path += "?state=" + url.QueryEscape(state)
+	}
+
+	resp, err := c.do("GET", path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, nil
+}
+
+// Delete removes a job, killing it first if it's still running
+func (c *Client) Delete(id int) error {
+	_, err := c.do("DELETE", c.jobPath(id), "", nil)
+	return err
+}
+
+// Signal sends a signal, e.g. "TERM" or "HUP", to a job's process
+// group, or cancels the job if it hasn't started yet.  The job is kept
+// around either way.
+func (c *Client) Signal(id int, signal string) (*server.JobJSON, error) {
+	return c.one("POST", c.jobPath(id)+"/signal?signal="+url.QueryEscape(signal), "", nil)
+}
+
+// Kill sends a job SIGKILL
+func (c *Client) Kill(id int) (*server.JobJSON, error) {
+	return c.Signal(id, "KILL")
+}
+
+// WriteStdin copies r to the stdin of a running job created with
+// StdinOpen, closing its stdin afterwards if asked to
+func (c *Client) WriteStdin(id int, r io.Reader, close bool) error {
+	path := fmt.Sprintf("%v/stdin?close=%v", c.jobPath(id), close)
+	_, err := c.do("POST", path, "application/octet-stream", r)
+	return err
+}
+
+// Wait long-polls a job until it's done, for at most WaitTimeout per
+// request
+func (c *Client) Wait(id int) (*server.JobJSON, error) {
+	path := fmt.Sprintf("%v?wait=%v", c.jobPath(id), c.WaitTimeout)
+	for {
+		j, err := c.one("GET", path, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		if isDone(j.State) {
+			return j, nil
+		}
+	}
+}
+
+// Stream copies a job's output stream ("out", "err" or "log") to w from
+// the given offset as it's written, returning once the job is done
+func (c *Client) Stream(id int, stream string, offset int, w io.Writer) error {
+	path := fmt.Sprintf("%v/%v?offset=%v", c.jobPath(id), stream, offset)
+	resp, err := c.request("GET", path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (c *Client) one(method, path, ctype string, body io.Reader) (*server.JobJSON, error) {
+	resp, err := c.do(method, path, ctype, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Jobs) != 1 {
+		return nil, fmt.Errorf("expected 1 job, got %v", len(resp.Jobs))
+	}
+	return resp.Jobs[0], nil
+}
+
+// do makes a request and decodes the jobs in the response, if any
+func (c *Client) do(method, path, ctype string, body io.Reader) (*server.JobResponse, error) {
+	if c.Fields != "" && method != "DELETE" {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "fields=" + url.QueryEscape(c.Fields)
+	}
+
+	resp, err := c.request(method, path, ctype, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	jr := &server.JobResponse{}
+	if resp.StatusCode == http.StatusNoContent {
+		return jr, nil
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(jr)
+	if err != nil {
+		return nil, err
+	}
+	return jr, nil
+}
+
+// request makes a request, turning anything but a 2xx into an *Error
+func (c *Client) request(method, path, ctype string, body io.Reader) (*http.Response, error) {
+	var bodyBytes []byte
+	if c.Sign && body != nil {
+		var err error
+		bodyBytes, err = ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Sign {
+		err = c.sign(req, bodyBytes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		req.Header.Set("Authorization", "rtot "+c.Secret)
+	}
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, &Error{StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	return resp, nil
+}
+
+// sign adds the headers of a signed request, the whole body of which is
+// given to be hashed
+func (c *Client) sign(req *http.Request, body []byte) error {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	signature := server.SignRequest(c.Secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if c.TokenName != "" {
+		signature = c.TokenName + ":" + signature
+	}
+	req.Header.Set("Authorization", "rtot-hmac "+signature)
+	req.Header.Set("Rtot-Timestamp", timestamp)
+	req.Header.Set("Rtot-Nonce", nonce)
+	return nil
+}
+
+func (c *Client) groupPath() string {
+	if c.Group == "" || c.Group == "main" {
+		return ""
+	}
+	return "/groups/" + url.QueryEscape(c.Group)
+}
+
+func (c *Client) jobsPath() string {
+	return c.groupPath() + "/jobs"
+}
+
+func (c *Client) jobPath(id int) string {
+	return c.jobsPath() + "/" + strconv.Itoa(id)
+}
+
+func isDone(state string) bool {
+	switch state {
+	case "complete", "failed", "timed_out", "killed", "lost", "cancelled":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/modcloth-labs/rtot/server"
+)
+
+// fakeServer answers like rtot does for a single job that completes
+// after a few polls
+type fakeServer struct {
+	sync.Mutex
+	polls    int
+	requests []*http.Request
+	created  *JobRequest
+
+	stdin       string
+	stdinClosed bool
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.requests = append(f.requests, req)
+	if !f.authorized(req) {
+		http.Error(w, "Not Authorized", http.StatusUnauthorized)
+		return
+	}
+
+	code := 3
+	j := &server.JobJSON{ID: 1, State: "running", Href: "/jobs/1"}
+
+	switch {
+	case req.Method == "POST" && req.URL.Path == "/jobs":
+		f.created = &JobRequest{}
+		json.NewDecoder(req.Body).Decode(f.created)
+		j.State = "new"
+		w.WriteHeader(201)
+	case req.Method == "POST" && req.URL.Path == "/jobs/batch":
+		batch := []*JobRequest{}
+		json.NewDecoder(req.Body).Decode(&batch)
+		resp := &server.JobResponse{Batch: 7}
+		for i := range batch {
+			resp.Jobs = append(resp.Jobs, &server.JobJSON{ID: i + 1, State: "new", Batch: 7})
+		}
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(resp)
+		return
+	case req.Method == "GET" && req.URL.Path == "/jobs/1/out":
+		fmt.Fprint(w, "hello\n")
+		return
+	case req.Method == "GET" && req.URL.Path == "/jobs/1":
+		if req.URL.Query().Get("wait") != "" {
+			f.polls++
+		}
+		if f.polls >= 3 {
+			j.State = "complete"
+			j.ExitCode = &code
+		}
+	case req.Method == "POST" && req.URL.Path == "/jobs/1/signal":
+		j.State = "killed"
+		j.KillSignal = "SIG" + req.URL.Query().Get("signal")
+	case req.Method == "POST" && req.URL.Path == "/jobs/1/stdin":
+		body, _ := ioutil.ReadAll(req.Body)
+		f.stdin = string(body)
+		f.stdinClosed = req.URL.Query().Get("close") == "true"
+		w.WriteHeader(204)
+		return
+	case req.Method == "DELETE" && req.URL.Path == "/jobs/1":
+		w.WriteHeader(204)
+		return
+	default:
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(&server.JobResponse{Jobs: []*server.JobJSON{}})
+		return
+	}
+
+	json.NewEncoder(w).Encode(&server.JobResponse{Jobs: []*server.JobJSON{j}})
+}
+
+// authorized accepts the secret swordfish, either sent as is or used to
+// sign the request as the deploy token
+func (f *fakeServer) authorized(req *http.Request) bool {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "rtot-hmac deploy:") {
+		return header == "rtot swordfish"
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	expected := server.SignRequest("swordfish", req.Method, req.URL.RequestURI(),
+		req.Header.Get("Rtot-Timestamp"), req.Header.Get("Rtot-Nonce"), body)
+	return header == "rtot-hmac deploy:"+expected
+}
+
+func newTestClient() (*Client, *fakeServer, func()) {
+	f := &fakeServer{}
+	ts := httptest.NewServer(f)
+	c := New(ts.URL, "swordfish")
+	return c, f, ts.Close
+}
+
+func TestClientCreatesJobs(t *testing.T) {
+	c, f, done := newTestClient()
+	defer done()
+
+	j, err := c.Create(&JobRequest{Script: "echo hello", Timeout: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.ID != 1 || j.State != "new" {
+		t.Errorf("unexpected job %+v", j)
+	}
+	if f.created.Script != "echo hello" || f.created.Timeout != "1m" {
+		t.Errorf("unexpected request %+v", f.created)
+	}
+	if f.requests[0].Header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected a JSON envelope")
+	}
+}
+
+func TestClientSignsRequests(t *testing.T) {
+	c, f, done := newTestClient()
+	defer done()
+	c.Sign = true
+	c.TokenName = "deploy"
+
+	if _, err := c.Create(&JobRequest{Script: "echo signed"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(1); err != nil {
+		t.Fatal(err)
+	}
+	if f.created.Script != "echo signed" {
+		t.Errorf("unexpected request %+v", f.created)
+	}
+	if f.requests[0].Header.Get("Rtot-Nonce") == f.requests[1].Header.Get("Rtot-Nonce") {
+		t.Errorf("expected a new nonce for each request")
+	}
+
+	c.Secret = "nope"
+	if _, err := c.Get(1); err == nil || err.(*Error).StatusCode != 401 {
+		t.Errorf("expected a bad signature to be refused, got %v", err)
+	}
+}
+
+func TestClientPresentsTLSClientCertificates(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.PeerCertificates) == 0 {
+			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&server.JobResponse{Jobs: []*server.JobJSON{}})
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "rtot-client-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(ts.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600)
+
+	c := New(ts.URL, "swordfish")
+	if _, err := c.List(""); err == nil {
+		t.Errorf("expected an unknown server certificate to be refused")
+	}
+
+	if err := c.UseTLS("", "", certFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.List(""); err == nil {
+		t.Errorf("expected a request without a client certificate to fail")
+	}
+
+	if err := c.UseTLS(certFile, keyFile, certFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.List(""); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestClientCreatesBatches(t *testing.T) {
+	c, _, done := newTestClient()
+	defer done()
+
+	jobs, batch, err := c.CreateBatch([]*JobRequest{{Script: "echo one"}, {Script: "echo two"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch != 7 || len(jobs) != 2 || jobs[1].Batch != 7 {
+		t.Errorf("unexpected batch %v of %+v", batch, jobs)
+	}
+}
+
+func TestClientWaitsForJobs(t *testing.T) {
+	c, f, done := newTestClient()
+	defer done()
+
+	j, err := c.Wait(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.State != "complete" || f.polls != 3 {
+		t.Errorf("unexpected job %+v after %v polls", j, f.polls)
+	}
+	if exitCode(j) != 3 {
+		t.Errorf("expected exit code 3, got %v", exitCode(j))
+	}
+}
+
+func TestClientStreamsOutput(t *testing.T) {
+	c, _, done := newTestClient()
+	defer done()
+
+	out := &strings.Builder{}
+	err := c.Stream(1, "out", 0, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestClientDeletesJobs(t *testing.T) {
+	c, _, done := newTestClient()
+	defer done()
+
+	if err := c.Delete(1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientKillsJobs(t *testing.T) {
+	c, _, done := newTestClient()
+	defer done()
+
+	j, err := c.Kill(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.State != "killed" || j.KillSignal != "SIGKILL" {
+		t.Errorf("unexpected job %+v", j)
+	}
+}
+
+func TestClientWritesStdin(t *testing.T) {
+	c, f, done := newTestClient()
+	defer done()
+
+	err := c.WriteStdin(1, strings.NewReader("SELECT 1;\n"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.stdin != "SELECT 1;\n" || !f.stdinClosed {
+		t.Errorf("unexpected stdin %q, closed %v", f.stdin, f.stdinClosed)
+	}
+}
+
+func TestClientReturnsErrors(t *testing.T) {
+	c, _, done := newTestClient()
+	defer done()
+
+	_, err := c.Get(2)
+	if e, ok := err.(*Error); !ok || e.StatusCode != 404 {
+		t.Errorf("expected a 404 *Error, got %v", err)
+	}
+
+	c.Secret = "nope"
+	_, err = c.List("")
+	if e, ok := err.(*Error); !ok || e.StatusCode != 401 {
+		t.Errorf("expected a 401 *Error, got %v", err)
+	}
+}
+
+func TestClientScopesPathsToGroups(t *testing.T) {
+	c := New("example.com:8457", "swordfish")
+	c.Group = "builds"
+	if c.BaseURL != "http://example.com:8457" {
+		t.Errorf("unexpected base URL %v", c.BaseURL)
+	}
+	if c.jobPath(4) != "/groups/builds/jobs/4" {
+		t.Errorf("unexpected job path %v", c.jobPath(4))
+	}
+}
+
+func TestParseInterspersed(t *testing.T) {
+	fl := flag.NewFlagSet("test", flag.ContinueOnError)
+	wait := fl.Bool("wait", false, "")
+	host := fl.String("H", "", "")
+
+	args := parseInterspersed(fl, []string{"-H", "host", "script.sh", "--wait", "--", "-x"})
+	if !*wait || *host != "host" {
+		t.Errorf("expected flags after the script to be parsed")
+	}
+	if len(args) != 2 || args[0] != "script.sh" || args[1] != "-x" {
+		t.Errorf("unexpected positional args %v", args)
+	}
+}
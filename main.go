@@ -1,9 +1,15 @@
 package main
 
 import (
+	"os"
+
+	"github.com/modcloth-labs/rtot/client"
 	"github.com/modcloth-labs/rtot/server"
 )
 
 func main() {
+	if len(os.Args) > 1 && client.IsCommand(os.Args[1]) {
+		os.Exit(client.CLIMain(os.Args[1:]))
+	}
 	server.ServerMain(nil)
 }
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var validParamName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// command is a named script from the catalog.  Each one is a pair of
+// files in the catalog directory: the executable script itself and a
+// <name>.json file describing it and the parameters it takes.
+type command struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Params      []*commandParam `json:"params"`
+
+	filename string
+}
+
+// commandParam is a parameter a command may be given.  Values must match
+// the whole of Pattern when there is one.  Params are passed as
+// environment variables named after the upper-cased param name, or as
+// arguments in the order they're declared when Arg is true.
+type commandParam struct {
+	Name     string `json:"name"`
+	Pattern  string `json:"pattern,omitempty"`
+	Required bool   `json:"required,omitempty"`
+	Default  string `json:"default,omitempty"`
+	Arg      bool   `json:"arg,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// resolve checks the given params against the command's, returning the
+// arguments and environment to run the command with
+func (cmd *command) resolve(params map[string]string) ([]string, map[string]string, error) {
+	args := []string{}
+	env := map[string]string{}
+
+	for name := range params {
+		if cmd.param(name) == nil {
+			return nil, nil, &jobRequestError{"param", name}
+		}
+	}
+
+	for _, p := range cmd.Params {
+		value, ok := params[p.Name]
+		if !ok {
+			if p.Required {
+				return nil, nil, &jobRequestError{"param " + p.Name, ""}
+			}
+			value = p.Default
+		}
+
+		if ok && p.re != nil && !p.re.MatchString(value) {
+			return nil, nil, &jobRequestError{"param " + p.Name, value}
+		}
+
+		if p.Arg {
+			args = append(args, value)
+			continue
+		}
+		env[strings.ToUpper(p.Name)] = value
+	}
+
+	return args, env, nil
+}
+
+func (cmd *command) param(name string) *commandParam {
+	for _, p := range cmd.Params {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// commandCatalog holds the commands loaded from a catalog directory and
+// may be reloaded at any time
+type commandCatalog struct {
+	sync.RWMutex
+	dir      string
+	commands map[string]*command
+}
+
+func newCommandCatalog(dir string) (*commandCatalog, error) {
+	cc := &commandCatalog{
+		dir:      dir,
+		commands: map[string]*command{},
+	}
+	if dir == "" {
+		return cc, nil
+	}
+
+	err := cc.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// Reload rereads the catalog directory, keeping the current commands if
+// it can't
+func (cc *commandCatalog) Reload() error {
+	metaFiles, err := filepath.Glob(filepath.Join(cc.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	commands := map[string]*command{}
+	for _, metaFile := range metaFiles {
+		cmd, err := loadCommand(metaFile)
+		if err != nil {
+			return err
+		}
+		commands[cmd.Name] = cmd
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	cc.commands = commands
+	return nil
+}
+
+func loadCommand(metaFile string) (*command, error) {
+	filename := strings.TrimSuffix(metaFile, ".json")
+	name := filepath.Base(filename)
+	if !validGroupName.MatchString(name) {
+		return nil, fmt.Errorf("invalid command name %q", name)
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command %v: %v", name, err)
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return nil, fmt.Errorf("invalid command %v: %v is not executable", name, filename)
+	}
+
+	metaBytes, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := &command{}
+	err = json.Unmarshal(metaBytes, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command %v: %v", name, err)
+	}
+
+	cmd.Name = name
+	cmd.filename = filename
+	if cmd.Params == nil {
+		cmd.Params = []*commandParam{}
+	}
+
+	for _, p := range cmd.Params {
+		if !validParamName.MatchString(p.Name) {
+			return nil, fmt.Errorf("invalid command %v: invalid param name %q", name, p.Name)
+		}
+		if p.Pattern != "" {
+			p.re, err = regexp.Compile("^(?:" + p.Pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid command %v: param %v: %v", name, p.Name, err)
+			}
+		}
+	}
+
+	return cmd, nil
+}
+
+func (cc *commandCatalog) Get(name string) *command {
+	cc.RLock()
+	defer cc.RUnlock()
+
+	return cc.commands[name]
+}
+
+// All returns every command sorted by name
+func (cc *commandCatalog) All() []*command {
+	cc.RLock()
+	defer cc.RUnlock()
+
+	names := []string{}
+	for name := range cc.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	commands := []*command{}
+	for _, name := range names {
+		commands = append(commands, cc.commands[name])
+	}
+	return commands
+}
+
+type commandResponse struct {
+	Commands []*command `json:"commands"`
+}
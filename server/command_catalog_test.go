@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCommandMeta = `{
+	"description": "Greets someone",
+	"params": [
+		{"name": "who", "pattern": "[a-z]+", "required": true, "arg": true},
+		{"name": "greeting", "pattern": "[A-Za-z]+", "default": "Hello"}
+	]
+}`
+
+func writeTestCatalog(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rtot-commands-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "greet"),
+		[]byte("#!/bin/bash\necho \"$GREETING, $1\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "greet.json"), []byte(testCommandMeta), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func withTestCatalog(t *testing.T) func() {
+	dir := writeTestCatalog(t)
+	cc, err := newCommandCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := false
+	if GetJobGroup("main") == nil {
+		_, err = NewJobGroup("main", "memory", "")
+		created = err == nil
+	}
+
+	testServerContext.commands = cc
+	return func() {
+		testServerContext.commands = nil
+		os.RemoveAll(dir)
+		if created {
+			RemoveJobGroup("main")
+		}
+	}
+}
+
+func TestCommandCatalogLoads(t *testing.T) {
+	dir := writeTestCatalog(t)
+	defer os.RemoveAll(dir)
+
+	cc, err := newCommandCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := cc.Get("greet")
+	if cmd == nil {
+		t.Fatalf("expected greet command in %v", cc.All())
+	}
+	if cmd.Description != "Greets someone" || len(cmd.Params) != 2 {
+		t.Errorf("unexpected command %+v", cmd)
+	}
+}
+
+func TestCommandCatalogRejectsUnexecutableScripts(t *testing.T) {
+	dir := writeTestCatalog(t)
+	defer os.RemoveAll(dir)
+
+	os.Chmod(filepath.Join(dir, "greet"), 0644)
+
+	_, err := newCommandCatalog(dir)
+	if err == nil {
+		t.Errorf("expected an error loading an unexecutable script")
+	}
+}
+
+func TestCommandResolvesParams(t *testing.T) {
+	dir := writeTestCatalog(t)
+	defer os.RemoveAll(dir)
+
+	cc, _ := newCommandCatalog(dir)
+	args, env, err := cc.Get("greet").resolve(map[string]string{"who": "world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 1 || args[0] != "world" {
+		t.Errorf("unexpected args %v", args)
+	}
+	if env["GREETING"] != "Hello" {
+		t.Errorf("unexpected env %v", env)
+	}
+}
+
+func TestCommandRejectsInvalidParams(t *testing.T) {
+	dir := writeTestCatalog(t)
+	defer os.RemoveAll(dir)
+
+	cc, _ := newCommandCatalog(dir)
+	for _, params := range []map[string]string{
+		{},
+		{"who": "world; rm -rf /"},
+		{"who": "world", "greeting": "$(id)"},
+		{"who": "world", "other": "thing"},
+	} {
+		_, _, err := cc.Get("greet").resolve(params)
+		if _, ok := err.(*jobRequestError); !ok {
+			t.Errorf("expected jobRequestError for %v, got %v", params, err)
+		}
+	}
+}
+
+func TestCommandJobRunsCatalogScript(t *testing.T) {
+	dir := writeTestCatalog(t)
+	defer os.RemoveAll(dir)
+
+	cc, _ := newCommandCatalog(dir)
+	jr := newTestJobRequest(t, "application/json", "/commands/greet",
+		`{"params": {"who": "world", "greeting": "Howdy"}}`)
+	jr.command = cc.Get("greet")
+
+	j, err := jr.newJob(&serverContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j.Run()
+	if j.outBuf.String() != "Howdy, world\n" {
+		t.Errorf("unexpected output %q %q", j.outBuf.String(), j.errBuf.String())
+	}
+
+	j.Cleanup()
+	if _, err := os.Stat(j.filename); err != nil {
+		t.Errorf("expected catalog script to survive cleanup: %v", err)
+	}
+}
+
+func TestServerCreatesCommandJobs(t *testing.T) {
+	defer withTestCatalog(t)()
+
+	resp := getResponse("POST", "/commands/greet?param=who=world", "", strings.NewReader(""), true)
+	if resp.Code != 201 {
+		testDumpFail(t, resp)
+	}
+
+	jr := &JobResponse{}
+	json.Unmarshal(resp.Body.Bytes(), jr)
+	if len(jr.Jobs) != 1 || jr.Jobs[0].Command != "greet" {
+		t.Errorf("unexpected response %v", resp.Body.String())
+	}
+
+	resp = getResponse("POST", "/commands/greet?param=who=NOPE", "", strings.NewReader(""), true)
+	if resp.Code != 400 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getResponse("POST", "/commands/nope", "", strings.NewReader(""), true)
+	if resp.Code != 404 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerRefusesScriptsInCommandsOnlyMode(t *testing.T) {
+	defer withTestCatalog(t)()
+	testServerContext.commandsOnly = true
+	defer func() { testServerContext.commandsOnly = false }()
+
+	resp := getResponse("POST", "/jobs", "", strings.NewReader("echo hi"), true)
+	if resp.Code != 403 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getResponse("POST", "/commands/greet", "application/json",
+		strings.NewReader(`{"params": {"who": "world"}}`), true)
+	if resp.Code != 201 {
+		testDumpFail(t, resp)
+	}
+}
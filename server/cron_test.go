@@ -0,0 +1,49 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2026, 10, 18, 9, 12, 30, 0, time.UTC)
+	for expr, expected := range map[string]time.Time{
+		"* * * * *":       time.Date(2026, 10, 18, 9, 13, 0, 0, time.UTC),
+		"*/15 * * * *":    time.Date(2026, 10, 18, 9, 15, 0, 0, time.UTC),
+		"0 3 * * *":       time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC),
+		"30 2 1 * *":      time.Date(2026, 11, 1, 2, 30, 0, 0, time.UTC),
+		"0 0 * * 1-5":     time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+		"0 12 * * 7":      time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+		"0 0 1 1 *":       time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		"@hourly":         time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC),
+		"0 0 13 * 5":      time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC),
+		"5,10 9-10 * * *": time.Date(2026, 10, 18, 10, 5, 0, 0, time.UTC),
+	} {
+		spec, err := parseCron(expr)
+		if err != nil {
+			t.Errorf("%q: %v", expr, err)
+			continue
+		}
+		if next := spec.next(from); !next.Equal(expected) {
+			t.Errorf("%q: expected %v, got %v", expr, expected, next)
+		}
+	}
+}
+
+func TestCronNeverMatching(t *testing.T) {
+	spec, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := spec.next(time.Now()); !next.IsZero() {
+		t.Errorf("expected no next time, got %v", next)
+	}
+}
+
+func TestParseCronRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
@@ -0,0 +1,554 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// diskJobGroupStore keeps jobs in memory like memoryJobGroupStore but
+// also writes each job's metadata beneath dir whenever its state changes,
+// and its captured output once it's done, so that they may be reloaded
+// when rtot restarts.  Reloaded output is read from its files as needed
+// rather than being held in memory.  The layout is:
+//
+//	<dir>/cur               next job id to hand out
+//	<dir>/jobs/<id>/job.json
+//	<dir>/jobs/<id>/out
+//	<dir>/jobs/<id>/err
+//	<dir>/jobs/<id>/log.json  spans of out and err, in order
+//	<dir>/schedules.json
+type diskJobGroupStore struct {
+	*memoryJobGroupStore
+	fileMutex sync.Mutex
+	dir       string
+	cur       int
+	destroyed bool
+	// saved are the jobs whose output has been written
+	saved map[int]bool
+}
+
+type diskJob struct {
+	ID       int           `json:"id"`
+	State    string        `json:"state"`
+	Exit     string        `json:"exit,omitempty"`
+	Create   time.Time     `json:"create"`
+	Start    time.Time     `json:"start"`
+	Complete time.Time     `json:"complete"`
+	Filename string        `json:"filename"`
+	Timeout  time.Duration `json:"timeout,omitempty"`
+	Status   *exitStatus   `json:"status,omitempty"`
+	Priority int           `json:"priority,omitempty"`
+	Dir      string        `json:"dir,omitempty"`
+	EnvKeys  []string      `json:"env_keys,omitempty"`
+	User     string        `json:"user,omitempty"`
+	Group    string        `json:"group,omitempty"`
+	Client   string        `json:"client,omitempty"`
+	Owner    string        `json:"owner,omitempty"`
+	Command  string        `json:"command,omitempty"`
+	Schedule int           `json:"schedule,omitempty"`
+	Batch    int           `json:"batch,omitempty"`
+
+	KillSignal string `json:"kill_signal,omitempty"`
+	OutBytes   int64  `json:"out_bytes,omitempty"`
+	ErrBytes   int64  `json:"err_bytes,omitempty"`
+	Log        bool   `json:"log,omitempty"`
+
+	RunAt time.Time        `json:"run_at,omitempty"`
+	After []*JobDependency `json:"after,omitempty"`
+
+	Attempts []*jobAttempt `json:"attempts,omitempty"`
+
+	Pending *diskCommand `json:"pending,omitempty"`
+}
+
+// diskCommand is everything needed to run a job that was still waiting
+// to when it was saved.  Only the env the job asked for is kept, so that
+// none of the server's own environment ends up on disk, and the rest is
+// filled in again from the server's environment on startup.  It is only
+// kept until the job starts.
+type diskCommand struct {
+	Args       []string            `json:"args"`
+	Env        map[string]string   `json:"env,omitempty"`
+	CleanEnv   bool                `json:"clean_env,omitempty"`
+	Credential *syscall.Credential `json:"credential,omitempty"`
+	Stdin      string              `json:"stdin,omitempty"`
+	OutputMax  int64               `json:"output_max,omitempty"`
+	Log        bool                `json:"log,omitempty"`
+	Retry      *RetryPolicy        `json:"retry,omitempty"`
+}
+
+// diskSchedule is a schedule's request, including its env values, along
+// with what it has done so far
+type diskSchedule struct {
+	ID      int              `json:"id"`
+	Request *scheduleRequest `json:"request"`
+	Client  string           `json:"client,omitempty"`
+	Owner   string           `json:"owner,omitempty"`
+	Create  time.Time        `json:"create"`
+	LastRun time.Time        `json:"last_run"`
+	LastJob int              `json:"last_job"`
+	Runs    int              `json:"runs"`
+	Skipped int              `json:"skipped"`
+}
+
+func newDiskJobGroupStore(dir string) (*diskJobGroupStore, error) {
+	d := &diskJobGroupStore{
+		memoryJobGroupStore: newMemoryJobGroupStore(),
+		dir:                 dir,
+		saved:               map[int]bool{},
+	}
+
+	err := os.MkdirAll(d.jobsDir(), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *diskJobGroupStore) Add(j *job) int {
+	d.memoryJobGroupStore.Add(j)
+	d.Save(j)
+	return j.id
+}
+
+func (d *diskJobGroupStore) Remove(i int) bool {
+	if !d.memoryJobGroupStore.Remove(i) {
+		return false
+	}
+
+	d.fileMutex.Lock()
+	defer d.fileMutex.Unlock()
+
+	os.RemoveAll(d.jobDir(i))
+	delete(d.saved, i)
+	return true
+}
+
+func (d *diskJobGroupStore) Save(j *job) error {
+	d.fileMutex.Lock()
+	defer d.fileMutex.Unlock()
+
+	if d.destroyed {
+		return nil
+	}
+
+	if j.id >= d.cur {
+		d.cur = j.id + 1
+		err := writeFileAtomic(filepath.Join(d.dir, "cur"),
+			[]byte(strconv.Itoa(d.cur)))
+		if err != nil {
+			return err
+		}
+	}
+
+	snap := j.snapshot()
+	dj := &diskJob{
+		ID:       j.id,
+		State:    snap.state,
+		Exit:     snap.exitString(),
+		Create:   j.createTime,
+		Start:    snap.startTime,
+		Complete: snap.completeTime,
+		Filename: j.filename,
+		Timeout:  j.timeout,
+		Status:   snap.status,
+		Priority: j.priority,
+		Dir:      j.dir,
+		EnvKeys:  j.envKeys,
+		User:     j.user,
+		Group:    j.groupName,
+		Client:   j.client,
+		Owner:    j.owner,
+		Command:  j.command,
+		Schedule: j.schedule,
+		Batch:    j.batch,
+
+		KillSignal: j.signalled(),
+		OutBytes:   j.outBuf.Written(),
+		ErrBytes:   j.errBuf.Written(),
+		Log:        j.outLog.Timed(),
+	}
+	dj.RunAt, _ = j.due()
+	dj.After = j.after
+	dj.Attempts = j.savedAttempts()
+	if isPending(snap.state) && !j.hasStarted() {
+		dj.Pending = newDiskCommand(j)
+	}
+
+	jsonBytes, err := json.Marshal(dj)
+	if err != nil {
+		return err
+	}
+
+	jobDir := d.jobDir(j.id)
+	err = os.MkdirAll(jobDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	if isDoneState(snap.state) && !d.saved[j.id] {
+		err = d.saveOutput(j, jobDir)
+		if err != nil {
+			return err
+		}
+		d.saved[j.id] = true
+	}
+
+	return writeFileAtomic(filepath.Join(jobDir, "job.json"), jsonBytes)
+}
+
+// saveOutput writes a finished job's output and log, which don't change
+// after that
+func (d *diskJobGroupStore) saveOutput(j *job, jobDir string) error {
+	err := writeFileAtomicFrom(filepath.Join(jobDir, "out"), j.outBuf)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomicFrom(filepath.Join(jobDir, "err"), j.errBuf)
+	if err != nil {
+		return err
+	}
+
+	logBytes, err := json.Marshal(j.outLog.Spans())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(jobDir, "log.json"), logBytes)
+}
+
+func (d *diskJobGroupStore) Cur() int {
+	d.fileMutex.Lock()
+	defer d.fileMutex.Unlock()
+
+	return d.cur
+}
+
+func (d *diskJobGroupStore) SaveSchedules(schedules []*schedule) error {
+	disk := []*diskSchedule{}
+	for _, s := range schedules {
+		disk = append(disk, &diskSchedule{
+			ID:      s.id,
+			Request: s.request,
+			Client:  s.request.client,
+			Owner:   s.request.owner,
+			Create:  s.createTime,
+			LastRun: s.lastRun,
+			LastJob: s.lastJob,
+			Runs:    s.runs,
+			Skipped: s.skipped,
+		})
+	}
+
+	jsonBytes, err := json.Marshal(disk)
+	if err != nil {
+		return err
+	}
+
+	d.fileMutex.Lock()
+	defer d.fileMutex.Unlock()
+
+	if d.destroyed {
+		return nil
+	}
+	return writeFileAtomic(filepath.Join(d.dir, "schedules.json"), jsonBytes)
+}
+
+// Destroy removes dir, and nothing is saved beneath it afterward, so jobs
+// that finish after their group is deleted don't bring it back
+func (d *diskJobGroupStore) Destroy() error {
+	d.fileMutex.Lock()
+	defer d.fileMutex.Unlock()
+
+	d.destroyed = true
+	return os.RemoveAll(d.dir)
+}
+
+func (d *diskJobGroupStore) LoadSchedules() ([]*schedule, error) {
+	jsonBytes, err := ioutil.ReadFile(filepath.Join(d.dir, "schedules.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	disk := []*diskSchedule{}
+	err = json.Unmarshal(jsonBytes, &disk)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedules in %v: %v", d.dir, err)
+	}
+
+	schedules := []*schedule{}
+	for _, ds := range disk {
+		s, err := newSchedule(ds.Request)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %v in %v: %v", ds.ID, d.dir, err)
+		}
+		s.id = ds.ID
+		s.request.client = ds.Client
+		s.request.owner = ds.Owner
+		s.createTime = ds.Create
+		s.lastRun = ds.LastRun
+		s.lastJob = ds.LastJob
+		s.runs = ds.Runs
+		s.skipped = ds.Skipped
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+func (d *diskJobGroupStore) jobsDir() string {
+	return filepath.Join(d.dir, "jobs")
+}
+
+func (d *diskJobGroupStore) jobDir(i int) string {
+	return filepath.Join(d.jobsDir(), strconv.Itoa(i))
+}
+
+// load reads back every job found beneath dir.  Jobs that were waiting
+// to run are made ready to run again, to be resubmitted once the group
+// starts.  Other jobs that had not completed when they were saved can no
+// longer be running, so they are marked as "lost".
+func (d *diskJobGroupStore) load() error {
+	curBytes, err := ioutil.ReadFile(filepath.Join(d.dir, "cur"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		d.cur, err = strconv.Atoi(string(bytes.TrimSpace(curBytes)))
+		if err != nil {
+			return fmt.Errorf("invalid job counter in %v: %v", d.dir, err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(d.jobsDir())
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
+
+		j, dj, err := d.loadJob(filepath.Join(d.jobsDir(), entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		if j.id >= d.cur {
+			d.cur = j.id + 1
+		}
+
+		if pending := newPendingJob(j, dj.Pending); pending != nil {
+			d.memoryJobGroupStore.Add(pending)
+			continue
+		}
+
+		d.memoryJobGroupStore.Add(j)
+		d.saved[j.id] = true
+		if !j.isDone() {
+			j.state = "lost"
+			d.Save(j)
+		}
+	}
+
+	return nil
+}
+
+func (d *diskJobGroupStore) loadJob(jobDir string) (*job, *diskJob, error) {
+	jsonBytes, err := ioutil.ReadFile(filepath.Join(jobDir, "job.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dj := &diskJob{}
+	err = json.Unmarshal(jsonBytes, dj)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid job in %v: %v", jobDir, err)
+	}
+
+	outBuf, err := newSavedOutputBuffer(filepath.Join(jobDir, "out"), dj.OutBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errBuf, err := newSavedOutputBuffer(filepath.Join(jobDir, "err"), dj.ErrBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	j := &job{
+		id:           dj.ID,
+		state:        dj.State,
+		outBuf:       outBuf,
+		errBuf:       errBuf,
+		createTime:   dj.Create,
+		startTime:    dj.Start,
+		completeTime: dj.Complete,
+		filename:     dj.Filename,
+		timeout:      dj.Timeout,
+		status:       dj.Status,
+		priority:     dj.Priority,
+		dir:          dj.Dir,
+		envKeys:      dj.EnvKeys,
+		user:         dj.User,
+		groupName:    dj.Group,
+		client:       dj.Client,
+		owner:        dj.Owner,
+		command:      dj.Command,
+		schedule:     dj.Schedule,
+		batch:        dj.Batch,
+		done:         make(chan struct{}),
+		killSignal:   dj.KillSignal,
+		runAt:        dj.RunAt,
+		after:        dj.After,
+		attempts:     dj.Attempts,
+	}
+	j.finish()
+
+	var spans []*logSpan
+	logBytes, err := ioutil.ReadFile(filepath.Join(jobDir, "log.json"))
+	if err == nil {
+		err = json.Unmarshal(logBytes, &spans)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid log in %v: %v", jobDir, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	j.outLog = newClosedOutputLog(j.outBuf, j.errBuf, spans, dj.Log)
+
+	if dj.Exit != "" {
+		j.exit = errors.New(dj.Exit)
+	}
+
+	return j, dj, nil
+}
+
+func writeFileAtomic(filename string, data []byte) error {
+	return writeFileAtomicFrom(filename, bytes.NewReader(data))
+}
+
+// writeFileAtomicFrom writes filename from src without it ever being
+// seen half written
+func writeFileAtomicFrom(filename string, src io.WriterTo) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+
+	_, err = src.WriteTo(f)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
+// isPending is true for the states of jobs that are waiting to run
+func isPending(state string) bool {
+	switch state {
+	case "scheduled", "queued", "blocked":
+		return true
+	}
+	return false
+}
+
+func newDiskCommand(j *job) *diskCommand {
+	if j.stdin != nil {
+		// whatever would have been written to an open stdin is gone
+		return nil
+	}
+
+	j.stateLock.Lock()
+	cmd := j.cmd
+	j.stateLock.Unlock()
+
+	dc := &diskCommand{
+		Args:       cmd.Args,
+		Env:        j.envExtra,
+		CleanEnv:   j.cleanEnv,
+		Credential: cmd.SysProcAttr.Credential,
+		Stdin:      j.stdinData,
+		OutputMax:  j.limits.max,
+		Log:        j.outLog.Timed(),
+	}
+	if j.retry != nil {
+		dc.Retry = j.retry.policy()
+	}
+	return dc
+}
+
+// newPendingJob rebuilds a job that was waiting to run when it was saved,
+// or returns nil if it can't be run again
+func newPendingJob(loaded *job, dc *diskCommand) *job {
+	if dc == nil || !isPending(loaded.state) || len(dc.Args) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(loaded.filename); err != nil {
+		return nil
+	}
+
+	j := newJobForFile(loaded.filename, dc.Args[1:]...)
+	j.id = loaded.id
+	j.state = loaded.state
+	j.createTime = loaded.createTime
+	j.timeout = loaded.timeout
+	j.priority = loaded.priority
+	j.dir = loaded.dir
+	j.envKeys = loaded.envKeys
+	j.user = loaded.user
+	j.groupName = loaded.groupName
+	j.client = loaded.client
+	j.owner = loaded.owner
+	j.command = loaded.command
+	j.schedule = loaded.schedule
+	j.batch = loaded.batch
+	j.after = loaded.after
+	if !loaded.runAt.IsZero() {
+		j.setRunAt(loaded.runAt)
+	}
+
+	j.cmd.Dir = loaded.dir
+	j.envExtra = dc.Env
+	j.cleanEnv = dc.CleanEnv
+	j.cmd.SysProcAttr.Credential = dc.Credential
+	if dc.Stdin != "" {
+		j.stdinData = dc.Stdin
+		j.cmd.Stdin = strings.NewReader(dc.Stdin)
+	}
+	if dc.Log {
+		j.recordLog()
+	}
+	j.limits.max = dc.OutputMax
+	if dc.Retry != nil {
+		j.retry, _ = dc.Retry.parse()
+	}
+	return j
+}
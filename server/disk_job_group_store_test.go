@@ -0,0 +1,215 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestDiskJobGroupStoreReloadsJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtot-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g, err := NewJobGroup("disk-reload", "disk", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := newJob("echo persisted ; exit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done.recordLog()
+	g.Add(done)
+	done.Run()
+
+	running, err := newJob("echo never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Add(running)
+
+	runningOut := filepath.Join(dir, "disk-reload", "jobs", strconv.Itoa(running.id), "out")
+	if _, err := os.Stat(runningOut); !os.IsNotExist(err) {
+		t.Errorf("expected output to be saved only once the job is done, got %v", err)
+	}
+
+	RemoveJobGroup(g.name)
+
+	g, err = NewJobGroup("disk-reload", "disk", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+
+	j := g.Get(done.id)
+	if j == nil {
+		t.Fatalf("job %v was not reloaded", done.id)
+	}
+
+	if j.state != "complete" {
+		t.Errorf("expected state complete, got %q", j.state)
+	}
+
+	if j.outBuf.String() != "persisted\n" || j.outBuf.buf.Len() != 0 {
+		t.Errorf("unexpected output %q", j.outBuf.String())
+	}
+
+	if !j.outLog.Timed() || len(j.outLog.Entries()) != 1 ||
+		j.outLog.Entries()[0].Data != "persisted\n" {
+		t.Errorf("expected the combined log to be reloaded")
+	}
+
+	if j.exit == nil || j.exit.Error() != "exit status 3" {
+		t.Errorf("unexpected exit %v", j.exit)
+	}
+
+	if g.Get(running.id).state != "lost" {
+		t.Errorf("expected unfinished job to be lost")
+	}
+
+	if i := g.Add(&job{state: "new", outBuf: done.outBuf, errBuf: done.errBuf, outLog: done.outLog}); i != 2 {
+		t.Errorf("expected job id 2 after reload, got %v", i)
+	}
+}
+
+func TestDiskJobGroupStoreRemoveForgetsJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtot-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g, err := NewJobGroup("disk-remove", "disk", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := newJob("echo gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Add(j)
+
+	if !g.Remove(j.id) {
+		t.Fatalf("failed to remove job %v", j.id)
+	}
+
+	RemoveJobGroup(g.name)
+
+	g, err = NewJobGroup("disk-remove", "disk", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+
+	if g.Get(j.id) != nil {
+		t.Errorf("removed job %v was reloaded", j.id)
+	}
+
+	if g.cur != 1 {
+		t.Errorf("expected job counter to survive removal, got %v", g.cur)
+	}
+}
+
+func TestDiskJobGroupStoreDestroyRemovesDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtot-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g, err := NewJobGroup("disk-destroy", "disk", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := newJob("echo gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Add(j)
+	if err := g.store.SaveSchedules(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	g.jobChanged(j, "complete")
+
+	if _, err := os.Stat(filepath.Join(dir, "disk-destroy")); !os.IsNotExist(err) {
+		t.Errorf("expected group dir to be removed, got %v", err)
+	}
+}
+
+func TestDiskJobGroupStoreResumesWaitingJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtot-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g, err := NewJobGroup("disk-resume", "disk", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, err := newJob("echo $GREETING $SECRET $SERVER")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduled.cmd.Env = []string{"GREETING=resumed", "SECRET=swordfish"}
+	scheduled.envExtra = map[string]string{"GREETING": "resumed"}
+	scheduled.setRunAt(time.Now().Add(time.Hour))
+	if err = g.Submit(scheduled); err != nil {
+		t.Fatal(err)
+	}
+	blocked, err := submitTestJob(t, g, "echo after",
+		&testJobOptions{after: []*JobDependency{{ID: scheduled.id}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	RemoveJobGroup(g.name)
+
+	saved, err := ioutil.ReadFile(filepath.Join(dir, "disk-resume", "jobs",
+		strconv.Itoa(scheduled.id), "job.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(saved), "swordfish") {
+		t.Errorf("expected only the job's own env to be saved, got %s", saved)
+	}
+
+	g, err = NewJobGroup("disk-resume", "disk", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+	g.Start(&serverContext{logger: logrus.New(), env: []string{"SERVER=restarted"}})
+
+	if err = g.Reschedule(scheduled.id, time.Now()); err != nil {
+		t.Fatalf("expected job %v to still be scheduled: %v", scheduled.id, err)
+	}
+
+	resumed, after := g.Get(scheduled.id), g.Get(blocked.id)
+	waitForTestJob(t, resumed)
+	waitForTestJob(t, after)
+
+	if resumed.state != "complete" || resumed.outBuf.String() != "resumed restarted\n" {
+		t.Errorf("unexpected state %v and output %q", resumed.state, resumed.outBuf.String())
+	}
+
+	if after.state != "complete" {
+		t.Errorf("expected job %v to run after job %v, got %v", after.id, resumed.id, after.state)
+	}
+}
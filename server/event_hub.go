@@ -0,0 +1,138 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+type jobEvent struct {
+	ID     int    `json:"-"`
+	Type   string `json:"type"`
+	JobID  int    `json:"job_id"`
+	State  string `json:"state"`
+	Exit   string `json:"exit,omitempty"`
+	Stream string `json:"stream,omitempty"`
+	Data   string `json:"data,omitempty"`
+	Time   string `json:"time"`
+
+	owner string
+}
+
+// eventFilter limits which events a subscriber receives.  Empty ids and
+// states match everything, and output events are only sent on request.
+type eventFilter struct {
+	ids    map[int]bool
+	states map[string]bool
+	output bool
+	token  *apiToken
+}
+
+func (f *eventFilter) matches(e *jobEvent) bool {
+	if e.Type == "output" && !f.output {
+		return false
+	}
+	if len(f.ids) > 0 && !f.ids[e.JobID] {
+		return false
+	}
+	if len(f.states) > 0 && !f.states[e.State] {
+		return false
+	}
+	if f.token != nil && !f.token.canSeeOwner(e.owner) {
+		return false
+	}
+	return true
+}
+
+type eventSubscription struct {
+	events chan *jobEvent
+	filter *eventFilter
+}
+
+// eventHub fans job lifecycle events out to subscribers.  Subscribers
+// that can't keep up miss events rather than holding up jobs.
+type eventHub struct {
+	sync.Mutex
+	cur  int
+	subs map[*eventSubscription]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: map[*eventSubscription]bool{}}
+}
+
+func (h *eventHub) Subscribe(filter *eventFilter) *eventSubscription {
+	h.Lock()
+	defer h.Unlock()
+
+	sub := &eventSubscription{
+		events: make(chan *jobEvent, 64),
+		filter: filter,
+	}
+	h.subs[sub] = true
+	return sub
+}
+
+func (h *eventHub) Unsubscribe(sub *eventSubscription) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.subs, sub)
+}
+
+// WantsOutput is true when any subscriber has asked for output events,
+// so that jobs don't build them for nobody
+func (h *eventHub) WantsOutput() bool {
+	h.Lock()
+	defer h.Unlock()
+
+	for sub := range h.subs {
+		if sub.filter.output {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *eventHub) Publish(eventType string, j *job) {
+	snap := j.snapshot()
+	h.publish(&jobEvent{Type: eventType, JobID: j.id, State: snap.state,
+		Exit: snap.exitString(), owner: j.owner})
+}
+
+func (h *eventHub) PublishOutput(j *job, stream string, data []byte) {
+	h.publish(&jobEvent{Type: "output", JobID: j.id, State: j.currentState(),
+		Stream: stream, Data: string(data), owner: j.owner})
+}
+
+func (h *eventHub) publish(e *jobEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	e.ID = h.cur
+	e.Time = time.Now().UTC().String()
+	h.cur++
+
+	for sub := range h.subs {
+		if !sub.filter.matches(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+		}
+	}
+}
+
+// outputEventWriter publishes whatever a job writes to one of its
+// streams to the job group's event hub
+type outputEventWriter struct {
+	j      *job
+	stream string
+}
+
+func (w *outputEventWriter) Write(p []byte) (int, error) {
+	if w.j.group != nil && w.j.group.events.WantsOutput() {
+		w.j.group.events.PublishOutput(w.j, w.stream, p)
+	}
+	return len(p), nil
+}
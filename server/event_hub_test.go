@@ -0,0 +1,56 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestEventHubPublishesJobLifecycle(t *testing.T) {
+	g, err := NewJobGroup("events-lifecycle", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := g.events.Subscribe(&eventFilter{})
+	defer g.events.Unsubscribe(sub)
+
+	j, err := newJob("echo hi ; exit 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Add(j)
+	j.Run()
+	g.Remove(j.id)
+
+	for _, expected := range []string{"created", "started", "completed", "deleted"} {
+		e := <-sub.events
+		if e.Type != expected {
+			t.Errorf("expected %q event, got %q", expected, e.Type)
+		}
+		if e.Type == "completed" && e.Exit != "exit status 2" {
+			t.Errorf("unexpected exit %q", e.Exit)
+		}
+	}
+}
+
+func TestEventFilterMatches(t *testing.T) {
+	f := &eventFilter{
+		ids:    map[int]bool{1: true},
+		states: map[string]bool{"complete": true},
+	}
+
+	if !f.matches(&jobEvent{Type: "completed", JobID: 1, State: "complete"}) {
+		t.Errorf("expected matching event to match")
+	}
+
+	if f.matches(&jobEvent{Type: "completed", JobID: 2, State: "complete"}) {
+		t.Errorf("expected other job's event not to match")
+	}
+
+	if f.matches(&jobEvent{Type: "started", JobID: 1, State: "running"}) {
+		t.Errorf("expected other state's event not to match")
+	}
+
+	if f.matches(&jobEvent{Type: "output", JobID: 1, State: "complete"}) {
+		t.Errorf("expected output event not to match without asking")
+	}
+}
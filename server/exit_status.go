@@ -0,0 +1,57 @@
+package server
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// exitStatus is everything worth knowing about how a job's process
+// exited, derived from its os.ProcessState
+type exitStatus struct {
+	Code       int           `json:"code"`
+	Signal     string        `json:"signal,omitempty"`
+	CoreDumped bool          `json:"core_dumped"`
+	Success    bool          `json:"success"`
+	UserTime   time.Duration `json:"user_time"`
+	SystemTime time.Duration `json:"system_time"`
+	MaxRSS     int64         `json:"max_rss"`
+}
+
+func newExitStatus(state *os.ProcessState) *exitStatus {
+	if state == nil {
+		return nil
+	}
+
+	status := &exitStatus{
+		Code:       -1,
+		Success:    state.Success(),
+		UserTime:   state.UserTime(),
+		SystemTime: state.SystemTime(),
+	}
+
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok {
+		if ws.Exited() {
+			status.Code = ws.ExitStatus()
+		}
+		if ws.Signaled() {
+			status.Signal = signalName(ws.Signal())
+			status.CoreDumped = ws.CoreDump()
+		}
+	}
+
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		status.MaxRSS = int64(ru.Maxrss)
+	}
+
+	return status
+}
+
+// exitCode is nil unless the process exited on its own
+func (s *exitStatus) exitCode() *int {
+	if s == nil || s.Code < 0 {
+		return nil
+	}
+	code := s.Code
+	return &code
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signed requests carry an Authorization header of
+//
+//	rtot-hmac [<token name>:]<signature>
+//
+// along with Rtot-Timestamp (unix seconds) and Rtot-Nonce headers.  The
+// signature is the hex HMAC-SHA256, keyed with the shared secret or the
+// named token's secret, of the method, request URI, timestamp, nonce and
+// hex SHA-256 of the body, each followed by a newline.  The body has to
+// be read to check the signature, so signed bodies are limited to
+// maxSignedBody bytes.
+
+const maxSignedBody = 32 << 20
+
+// SignRequest computes the signature for a request, for the server to
+// check and clients to sign with
+func SignRequest(secret, method, uri, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x\n", method, uri, timestamp, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nonceCache remembers the nonces seen within the allowed clock skew so
+// that signed requests can't be replayed.  The nonces are also kept in
+// the order they were seen, so the ones too old to matter can be
+// forgotten from the front without looking at the rest.
+type nonceCache struct {
+	sync.Mutex
+	seen  map[string]time.Time
+	order []*seenNonce
+}
+
+type seenNonce struct {
+	nonce string
+	at    time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: map[string]time.Time{}}
+}
+
+// Check is true the first time a nonce is seen, forgetting nonces that
+// are too old to be accepted anyway
+func (n *nonceCache) Check(nonce string, now time.Time, window time.Duration) bool {
+	n.Lock()
+	defer n.Unlock()
+
+	expired := 0
+	for _, s := range n.order {
+		if now.Sub(s.at) <= 2*window {
+			break
+		}
+		delete(n.seen, s.nonce)
+		expired++
+	}
+	n.order = n.order[expired:]
+
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	n.seen[nonce] = now
+	n.order = append(n.order, &seenNonce{nonce, now})
+	return true
+}
+
+// authenticateHMAC verifies a signed request, returning its token or nil
+func (c *serverContext) authenticateHMAC(res http.ResponseWriter, req *http.Request,
+	credentials string) *apiToken {
+
+	token, secret := adminToken, c.secret
+	signature := credentials
+	if parts := strings.SplitN(credentials, ":", 2); len(parts) == 2 {
+		if c.tokens == nil {
+			return nil
+		}
+		token = c.tokens.GetByName(parts[0])
+		if token == nil {
+			return nil
+		}
+		secret, signature = token.Secret, parts[1]
+	}
+
+	timestamp := req.Header.Get("Rtot-Timestamp")
+	nonce := req.Header.Get("Rtot-Nonce")
+	if timestamp == "" || nonce == "" {
+		return nil
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew < -c.hmacSkew || skew > c.hmacSkew {
+		return nil
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, err = ioutil.ReadAll(http.MaxBytesReader(res, req.Body, maxSignedBody))
+		if err != nil {
+			return nil
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := SignRequest(secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil
+	}
+
+	if !c.nonces.Check(token.Name+":"+nonce, now, c.hmacSkew) {
+		return nil
+	}
+
+	return token
+}
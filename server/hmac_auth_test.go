@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSignedRequest(t *testing.T, secret, keyPrefix, body string, at time.Time, nonce string) *http.Request {
+	req, err := http.NewRequest("POST", "/jobs?priority=1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	req.Header.Set("Rtot-Timestamp", timestamp)
+	req.Header.Set("Rtot-Nonce", nonce)
+	req.Header.Set("Authorization", fmt.Sprintf("rtot-hmac %v%v", keyPrefix,
+		SignRequest(secret, "POST", "/jobs?priority=1", timestamp, nonce, []byte(body))))
+	return req
+}
+
+func newHMACTestContext() *serverContext {
+	return &serverContext{
+		secret:   "swordfish",
+		hmacSkew: time.Minute,
+		nonces:   newNonceCache(),
+	}
+}
+
+func TestAuthenticateHMACAcceptsSignedRequest(t *testing.T) {
+	c := newHMACTestContext()
+	req := newSignedRequest(t, "swordfish", "", "echo signed", time.Now(), "n1")
+
+	if c.authenticate(httptest.NewRecorder(), req) != adminToken {
+		t.Fatalf("expected signed request to be accepted")
+	}
+
+	body := make([]byte, 32)
+	n, _ := req.Body.Read(body)
+	if string(body[:n]) != "echo signed" {
+		t.Errorf("expected body to be readable after verification, got %q", body[:n])
+	}
+}
+
+func TestAuthenticateHMACRejectsReplays(t *testing.T) {
+	c := newHMACTestContext()
+
+	req := newSignedRequest(t, "swordfish", "", "echo", time.Now(), "n2")
+	if c.authenticate(httptest.NewRecorder(), req) == nil {
+		t.Fatalf("expected first request to be accepted")
+	}
+
+	req = newSignedRequest(t, "swordfish", "", "echo", time.Now(), "n2")
+	if c.authenticate(httptest.NewRecorder(), req) != nil {
+		t.Errorf("expected replayed nonce to be refused")
+	}
+}
+
+func TestNonceCacheForgetsOldNonces(t *testing.T) {
+	n := newNonceCache()
+	start := time.Now()
+
+	for i, nonce := range []string{"a", "b", "c"} {
+		if !n.Check(nonce, start.Add(time.Duration(i)*time.Minute), time.Minute) {
+			t.Fatalf("expected nonce %v to be new", nonce)
+		}
+	}
+
+	if !n.Check("d", start.Add(150*time.Second), time.Minute) {
+		t.Fatalf("expected nonce d to be new")
+	}
+	if _, ok := n.seen["a"]; ok || len(n.order) != 3 {
+		t.Errorf("expected only nonce a to be forgotten, have %v", n.seen)
+	}
+	if n.Check("b", start.Add(150*time.Second), time.Minute) {
+		t.Errorf("expected nonce b to still be remembered")
+	}
+}
+
+func TestAuthenticateHMACRejectsBadRequests(t *testing.T) {
+	c := newHMACTestContext()
+
+	stale := newSignedRequest(t, "swordfish", "", "echo", time.Now().Add(-time.Hour), "n3")
+	if c.authenticate(httptest.NewRecorder(), stale) != nil {
+		t.Errorf("expected stale timestamp to be refused")
+	}
+
+	wrong := newSignedRequest(t, "wrong", "", "echo", time.Now(), "n4")
+	if c.authenticate(httptest.NewRecorder(), wrong) != nil {
+		t.Errorf("expected wrong secret to be refused")
+	}
+
+	tampered := newSignedRequest(t, "swordfish", "", "echo", time.Now(), "n5")
+	tampered.Body = http.NoBody
+	if c.authenticate(httptest.NewRecorder(), tampered) != nil {
+		t.Errorf("expected tampered body to be refused")
+	}
+
+	huge := strings.Repeat("x", maxSignedBody+1)
+	tooBig := newSignedRequest(t, "swordfish", "", huge, time.Now(), "n7")
+	if c.authenticate(httptest.NewRecorder(), tooBig) != nil {
+		t.Errorf("expected oversized body to be refused")
+	}
+}
+
+func TestAuthenticateHMACWithNamedToken(t *testing.T) {
+	filename := writeTestTokens(t, testTokens)
+	defer os.Remove(filename)
+
+	ts, err := newTokenStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newHMACTestContext()
+	c.tokens = ts
+
+	req := newSignedRequest(t, "ci-secret", "ci:", "echo", time.Now(), "n6")
+	tok := c.authenticate(httptest.NewRecorder(), req)
+	if tok == nil || tok.Name != "ci" {
+		t.Errorf("expected ci token, got %v", tok)
+	}
+}
+
+func TestAuthenticateHMACOnlyRefusesPlainSecret(t *testing.T) {
+	c := newHMACTestContext()
+	c.hmacOnly = true
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "rtot swordfish")
+	if c.authenticate(httptest.NewRecorder(), req) != nil {
+		t.Errorf("expected plain secret to be refused")
+	}
+}
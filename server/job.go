@@ -1,19 +1,22 @@
 package server
 
 import (
-	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type job struct {
 	id           int
-	outBuf       *bytes.Buffer
-	errBuf       *bytes.Buffer
+	outBuf       *outputBuffer
+	errBuf       *outputBuffer
+	outLog       *outputLog
 	cmd          *exec.Cmd
 	state        string
 	createTime   time.Time
@@ -21,6 +24,36 @@ type job struct {
 	completeTime time.Time
 	filename     string
 	exit         error
+	group        *jobGroup
+	timeout      time.Duration
+	grace        time.Duration
+	status       *exitStatus
+	priority     int
+	dir          string
+	envKeys      []string
+	envExtra     map[string]string
+	cleanEnv     bool
+	user         string
+	groupName    string
+	client       string
+	owner        string
+	command      string
+	schedule     int
+	done         chan struct{}
+	doneOnce     sync.Once
+	stateLock    sync.Mutex
+	started      bool
+	killSignal   string
+	stdin        *jobStdin
+	stdinData    string
+	limits       outputLimits
+	runAt        time.Time
+	runAtChanged chan struct{}
+	after        []*JobDependency
+	batch        int
+	retry        *retryPolicy
+	attempts     []*jobAttempt
+	retryWake    chan struct{}
 }
 
 func newJob(script string) (*job, error) {
@@ -56,65 +89,501 @@ func newJob(script string) (*job, error) {
 	filename := f.Name()
 	f.Close()
 
+	return newJobForFile(filename), nil
+}
+
+// newCommandJob runs a script from the command catalog, which unlike the
+// temp files built from submitted scripts is left alone on cleanup
+func newCommandJob(name, filename string, args []string) *job {
+	j := newJobForFile(filename, args...)
+	j.command = name
+	return j
+}
+
+func newJobForFile(filename string, args ...string) *job {
 	var (
-		outbuf bytes.Buffer
-		errbuf bytes.Buffer
+		outbuf = newOutputBuffer()
+		errbuf = newOutputBuffer()
+		outlog = newOutputLog(outbuf, errbuf)
 	)
 
-	cmd := exec.Command(filename)
-	cmd.Stdout = &outbuf
-	cmd.Stderr = &errbuf
-
-	return &job{
+	cmd := exec.Command(filename, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	j := &job{
 		cmd:        cmd,
 		state:      "new",
-		outBuf:     &outbuf,
-		errBuf:     &errbuf,
+		outBuf:     outbuf,
+		errBuf:     errbuf,
+		outLog:     outlog,
 		createTime: time.Now().UTC(),
 		filename:   filename,
-	}, nil
+		done:       make(chan struct{}),
+	}
+
+	cmd.Stdout = io.MultiWriter(outbuf, outlog.writer("out"), &outputEventWriter{j, "out"})
+	cmd.Stderr = io.MultiWriter(errbuf, outlog.writer("err"), &outputEventWriter{j, "err"})
+
+	return j
+}
+
+// recordLog timestamps each write in the job's combined log, and must be
+// called before the job starts
+func (j *job) recordLog() {
+	j.outLog.setTimed()
 }
 
 func (j *job) Run() {
+	j.run(nil)
+}
+
+// run runs the job, and any retries, in the place g's queue gave it
+func (j *job) run(g *jobGroup) {
+	started, err := j.start()
+	if !started {
+		return
+	}
+	j.changed("started")
+
+	for {
+		timedOut, exit := false, err
+		if err == nil {
+			timedOut, exit = j.wait()
+		}
+
+		backoff, retry := j.ended(timedOut, exit)
+		if !retry {
+			break
+		}
+		j.changed("retrying")
+
+		started, err = j.nextAttempt(backoff, g)
+		if !started {
+			break
+		}
+		j.changed("started")
+	}
+	if j.stdin != nil {
+		j.stdin.Close()
+	}
+
+	select {
+	case <-j.Done():
+		// cancelled while queued for another attempt
+		return
+	default:
+	}
+
+	j.stateLock.Lock()
+	j.completeTime = time.Now().UTC()
+	state := j.state
+	j.stateLock.Unlock()
+
+	j.closeOutput()
+	j.finish()
+
+	switch state {
+	case "timed_out":
+		j.changed("timed_out")
+	case "killed":
+		j.changed("killed")
+	case "failed":
+		j.changed("failed")
+	default:
+		j.changed("completed")
+	}
+}
+
+// ended records how the job's command finished.  If the job's retry
+// policy says to try again, the job is left "retrying" and how long to
+// wait first is returned.
+func (j *job) ended(timedOut bool, exit error) (time.Duration, bool) {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	j.exit = exit
+	j.status = newExitStatus(j.cmd.ProcessState)
+
+	state := "complete"
+	switch {
+	case timedOut:
+		state = "timed_out"
+	case j.status != nil && j.status.Signal != "" && j.killSignal != "":
+		state = "killed"
+	}
+	j.endAttempt(state)
+
+	if backoff, ok := j.retryAfter(state); ok {
+		j.state = "retrying"
+		j.retryWake = make(chan struct{})
+		return backoff, true
+	}
+
+	// with a retry policy, a job that exits unsuccessfully in the end failed
+	succeeded := j.status != nil && j.status.Success
+	if j.retry != nil && state == "complete" && !succeeded {
+		state = "failed"
+	}
+	j.state = state
+	return 0, false
+}
+
+// start starts the job's command unless the job was cancelled before it
+// got the chance, in which case it never runs
+func (j *job) start() (bool, error) {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	if j.killSignal != "" {
+		return false, nil
+	}
+
 	j.state = "running"
 	j.startTime = time.Now().UTC()
-	j.exit = j.cmd.Run()
-	j.state = "complete"
+	j.started = true
+	j.beginAttempt()
+
+	err := j.cmd.Start()
+	if err == nil && j.stdin != nil {
+		go j.stdin.writePending()
+	}
+	return true, err
+}
+
+// wait waits for the job's command to exit.  Once the job's timeout has
+// elapsed, its process group is sent SIGTERM and then SIGKILL if it's
+// still around after the grace period.
+func (j *job) wait() (bool, error) {
+	j.stateLock.Lock()
+	cmd := j.cmd
+	j.stateLock.Unlock()
+
+	if j.timeout <= 0 {
+		return false, cmd.Wait()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return false, err
+	case <-time.After(j.timeout):
+	}
+
+	j.lockedSignal(syscall.SIGTERM)
+
+	select {
+	case err := <-done:
+		return true, err
+	case <-time.After(j.grace):
+	}
+
+	j.lockedSignal(syscall.SIGKILL)
+	return true, <-done
+}
+
+// Signal sends sig to the job's process group, publishing a "signalled"
+// event first and recording sig if it's one that ends jobs.  A job that
+// hasn't started yet, or is queued for another attempt, is cancelled
+// instead by those signals, so that it never runs again, which the
+// caller must finish off.  Other signals can't be sent until there's a
+// process to send them to.
+func (j *job) Signal(sig syscall.Signal) (bool, error) {
+	terminating := terminatingSignals[sig]
+
+	j.stateLock.Lock()
+	if !j.started || j.state == "queued" {
+		defer j.stateLock.Unlock()
+
+		if !terminating {
+			return false, errJobNotRunning
+		}
+		j.killSignal = signalName(sig)
+		return true, nil
+	}
+	if terminating {
+		j.killSignal = signalName(sig)
+	}
+	j.stateLock.Unlock()
+
+	if j.group != nil {
+		j.group.events.Publish("signalled", j)
+	}
+
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	if j.state == "retrying" {
+		if !terminating {
+			return false, errJobNotRunning
+		}
+		// there's no process between attempts, so just stop retrying
+		if j.retryWake != nil {
+			close(j.retryWake)
+			j.retryWake = nil
+		}
+		return false, nil
+	}
+	return false, j.signal(sig)
+}
+
+// setRunAt holds the job until runAt once it's submitted, waking up
+// anything waiting on the old run time
+func (j *job) setRunAt(runAt time.Time) {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	j.runAt = runAt.UTC()
+	if j.runAtChanged != nil {
+		close(j.runAtChanged)
+	}
+	j.runAtChanged = make(chan struct{})
+}
+
+// due is when the job should run, which is the zero time for right
+// away, and a channel that is closed if that changes
+func (j *job) due() (time.Time, <-chan struct{}) {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	return j.runAt, j.runAtChanged
+}
+
+// currentState is the job's state as of now
+func (j *job) currentState() string {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	return j.state
+}
+
+// setState moves a job that isn't running along to state
+func (j *job) setState(state string) {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	j.state = state
+}
+
+// end finishes a job that will now never run, leaving it in state
+func (j *job) end(state string) {
+	j.stateLock.Lock()
+	j.state = state
 	j.completeTime = time.Now().UTC()
+	j.stateLock.Unlock()
+
+	j.closeOutput()
+	j.finish()
+}
+
+// completed is when the job finished, or the zero time if it hasn't
+func (j *job) completed() time.Time {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	return j.completeTime
+}
+
+func (j *job) hasStarted() bool {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	return j.started
+}
+
+// signalled is the name of the last signal asked for, if any
+func (j *job) signalled() string {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	return j.killSignal
+}
+
+func (j *job) lockedSignal(sig syscall.Signal) error {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	return j.signal(sig)
+}
+
+// signal sends sig to every process in the job's process group, and
+// must be called with the state lock held
+func (j *job) signal(sig syscall.Signal) error {
+	if j.cmd == nil || j.cmd.Process == nil {
+		return errJobNotRunning
+	}
+	return syscall.Kill(-j.cmd.Process.Pid, sig)
+}
+
+// Done is closed once the job is done, or will never run
+func (j *job) Done() <-chan struct{} {
+	return j.done
+}
+
+func (j *job) finish() {
+	j.doneOnce.Do(func() {
+		if j.done != nil {
+			close(j.done)
+		}
+	})
+}
+
+// jobSnapshot is a copy of the parts of a job that change as it runs,
+// all taken at the same time
+type jobSnapshot struct {
+	state        string
+	startTime    time.Time
+	completeTime time.Time
+	exit         error
+	status       *exitStatus
+}
+
+func (j *job) snapshot() *jobSnapshot {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	return &jobSnapshot{
+		state:        j.state,
+		startTime:    j.startTime,
+		completeTime: j.completeTime,
+		exit:         j.exit,
+		status:       j.status,
+	}
+}
+
+// elapsed is how long the job has been running, or ran for
+func (s *jobSnapshot) elapsed() time.Duration {
+	if s.startTime.IsZero() {
+		return 0
+	}
+	if s.completeTime.IsZero() {
+		return time.Since(s.startTime)
+	}
+	return s.completeTime.Sub(s.startTime)
+}
+
+func (s *jobSnapshot) exitString() string {
+	return exitString(s.exit)
 }
 
 func (j *job) Cleanup() error {
-	if j.cmd.Process != nil {
+	j.stateLock.Lock()
+	if j.cmd != nil && j.cmd.Process != nil {
 		j.cmd.Process.Release()
 	}
+	j.stateLock.Unlock()
+
+	j.outBuf.Remove()
+	j.errBuf.Remove()
+	j.finish()
+	if j.stdin != nil {
+		j.stdin.Close()
+	}
+	if j.command != "" {
+		return nil
+	}
 	return os.Remove(j.filename)
 }
 
+// outputStream is output that readers may follow as it arrives
+type outputStream interface {
+	Since(offset int) ([]byte, bool, <-chan struct{})
+}
+
+// output returns the named stream, which is one of "out", "err" or "log"
+// (both interleaved)
+func (j *job) output(stream string) outputStream {
+	switch stream {
+	case "out":
+		return j.outBuf
+	case "err":
+		return j.errBuf
+	case "log":
+		return j.outLog
+	}
+	return nil
+}
+
+func (j *job) closeOutput() {
+	j.outBuf.Close()
+	j.errBuf.Close()
+	j.outLog.Close()
+}
+
+// setOutputLimits must be called before the job starts
+func (j *job) setOutputLimits(limits outputLimits) {
+	j.limits = limits
+	j.outBuf.setLimits(limits)
+	j.errBuf.setLimits(limits)
+	j.outLog.setLimits(limits)
+}
+
+// isDone is true once a job will never run again
+func (j *job) isDone() bool {
+	return isDoneState(j.currentState())
+}
+
+func isDoneState(state string) bool {
+	switch state {
+	case "complete", "failed", "timed_out", "killed", "lost", "cancelled":
+		return true
+	}
+	return false
+}
+
+// outputSize is how much the job's output takes, including its log
+func (j *job) outputSize() int64 {
+	return int64(j.outBuf.Len()+j.errBuf.Len()) + j.outLog.Size()
+}
+
+func exitString(exit error) string {
+	if exit == nil {
+		return ""
+	}
+	return exit.Error()
+}
+
+// changed lets the owning job group know that the job's state has moved
+func (j *job) changed(eventType string) {
+	if j.group != nil {
+		j.group.jobChanged(j, eventType)
+	}
+}
+
 func (j *job) Href() string {
-	return fmt.Sprintf("/jobs/%v", j.id)
+	if j.group == nil || j.group.name == "main" {
+		return fmt.Sprintf("/jobs/%v", j.id)
+	}
+	return fmt.Sprintf("/groups/%v/jobs/%v", j.group.name, j.id)
+}
+
+func (j *job) toJSON(fields *map[string]int) *JobJSON {
+	return j.toRangedJSON(fields, 0, -1)
 }
 
-func (j *job) toJSON(fields *map[string]int) *jobJSON {
+// toRangedJSON only includes up to limit bytes of output from offset on,
+// or everything from offset on when limit is negative
+func (j *job) toRangedJSON(fields *map[string]int, offset, limit int64) *JobJSON {
 	fieldsMap := *fields
+	snap := j.snapshot()
 
-	exitString := ""
 	outStr := ""
 	errStr := ""
 	startString := ""
 	completeString := ""
 	createString := ""
 	filenameString := ""
-
-	if j.exit != nil {
-		exitString = j.exit.Error()
-	}
+	elapsedString := ""
+	timeoutString := ""
 
 	if _, ok := fieldsMap["out"]; ok {
-		outStr = string(j.outBuf.Bytes())
+		outStr = string(j.outBuf.Range(offset, limit))
 	}
 
 	if _, ok := fieldsMap["err"]; ok {
-		errStr = string(j.errBuf.Bytes())
+		errStr = string(j.errBuf.Range(offset, limit))
 	}
 
 	if _, ok := fieldsMap["create"]; ok {
@@ -122,32 +591,108 @@ func (j *job) toJSON(fields *map[string]int) *jobJSON {
 	}
 
 	if _, ok := fieldsMap["start"]; ok {
-		startString = j.startTime.String()
+		startString = snap.startTime.String()
 	}
 
 	if _, ok := fieldsMap["complete"]; ok {
-		completeString = j.completeTime.String()
+		completeString = snap.completeTime.String()
 	}
 
 	if _, ok := fieldsMap["filename"]; ok {
 		filenameString = j.filename
 	}
 
-	return &jobJSON{
+	if elapsed := snap.elapsed(); elapsed > 0 {
+		elapsedString = elapsed.String()
+	}
+
+	if j.timeout > 0 {
+		timeoutString = j.timeout.String()
+	}
+
+	jj := &JobJSON{
 		ID:       j.id,
 		Out:      outStr,
 		Err:      errStr,
-		State:    j.state,
-		Exit:     exitString,
+		State:    snap.state,
+		Exit:     snap.exitString(),
 		Start:    startString,
 		Complete: completeString,
 		Create:   createString,
 		Filename: filenameString,
+		Elapsed:  elapsedString,
+		Timeout:  timeoutString,
+		Priority: j.priority,
+		User:     j.user,
+		Group:    j.groupName,
+		Client:   j.client,
+		Owner:    j.owner,
+		Command:  j.command,
+		Schedule: j.schedule,
+		Batch:    j.batch,
 		Href:     j.Href(),
 	}
+
+	jj.KillSignal = j.signalled()
+	jj.After = j.after
+	if runAt, _ := j.due(); !runAt.IsZero() {
+		jj.RunAt = runAt.String()
+	}
+	jj.OutBytes = j.outBuf.Written()
+	jj.ErrBytes = j.errBuf.Written()
+	jj.Truncated = j.outBuf.Truncated() || j.errBuf.Truncated() || j.outLog.Truncated()
+	if _, ok := fieldsMap["log"]; ok && j.outLog.Timed() {
+		jj.Log = j.outLog.Entries()
+	}
+	if j.stdin != nil {
+		jj.Stdin = j.stdin.state()
+	}
+	if attempts := j.attemptsJSON(fieldsMap); len(attempts) > 0 {
+		jj.Attempts = attempts
+	}
+
+	if _, ok := fieldsMap["dir"]; ok {
+		jj.Dir = j.dir
+	}
+
+	if _, ok := fieldsMap["env"]; ok {
+		jj.Env = j.envKeys
+	}
+
+	if snap.state == "queued" && j.group != nil {
+		jj.QueuePosition = j.group.queue.position(j)
+	}
+
+	if snap.status != nil {
+		if _, ok := fieldsMap["exit_code"]; ok {
+			jj.ExitCode = snap.status.exitCode()
+		}
+
+		if _, ok := fieldsMap["signal"]; ok {
+			jj.Signal = snap.status.Signal
+		}
+
+		if _, ok := fieldsMap["core_dumped"]; ok {
+			jj.CoreDumped = &snap.status.CoreDumped
+		}
+
+		if _, ok := fieldsMap["success"]; ok {
+			jj.Success = &snap.status.Success
+		}
+
+		if _, ok := fieldsMap["rusage"]; ok {
+			jj.UserTime = snap.status.UserTime.String()
+			jj.SystemTime = snap.status.SystemTime.String()
+			jj.MaxRSS = snap.status.MaxRSS
+		}
+	}
+
+	return jj
 }
 
-type jobJSON struct {
+// JobJSON is how a job is described to clients, with most fields only
+// present when asked for
+type JobJSON struct {
 	ID       int    `json:"id"`
 	Out      string `json:"out,omitempty"`
 	Err      string `json:"err,omitempty"`
@@ -157,5 +702,42 @@ type jobJSON struct {
 	Complete string `json:"complete,omitempty"`
 	Create   string `json:"create,omitempty"`
 	Filename string `json:"filename,omitempty"`
+	Elapsed  string `json:"elapsed,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	User     string `json:"user,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Client   string `json:"client,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	Command  string `json:"command,omitempty"`
+	Schedule int    `json:"schedule,omitempty"`
+	Batch    int    `json:"batch,omitempty"`
 	Href     string `json:"href"`
+
+	KillSignal string `json:"kill_signal,omitempty"`
+	Stdin      string `json:"stdin,omitempty"`
+	RunAt      string `json:"run_at,omitempty"`
+
+	After []*JobDependency `json:"after,omitempty"`
+
+	OutBytes  int64 `json:"out_bytes,omitempty"`
+	ErrBytes  int64 `json:"err_bytes,omitempty"`
+	Truncated bool  `json:"truncated,omitempty"`
+
+	Log []*LogEntry `json:"log,omitempty"`
+
+	Attempts []*AttemptJSON `json:"attempts,omitempty"`
+
+	Dir string   `json:"dir,omitempty"`
+	Env []string `json:"env,omitempty"`
+
+	QueuePosition int `json:"queue_position,omitempty"`
+
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	Signal     string `json:"signal,omitempty"`
+	CoreDumped *bool  `json:"core_dumped,omitempty"`
+	Success    *bool  `json:"success,omitempty"`
+	UserTime   string `json:"user_time,omitempty"`
+	SystemTime string `json:"system_time,omitempty"`
+	MaxRSS     int64  `json:"max_rss,omitempty"`
 }
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+)
+
+// newBatchRequests reads the job requests in a batch, given either as a
+// JSON array of job envelopes or as a multipart body with a part per
+// job, each either a JSON envelope or a plain script
+func newBatchRequests(req *http.Request) ([]*jobRequest, error) {
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	client := clientSubject(req)
+	requests := []*jobRequest{}
+	newRequest := func() *jobRequest {
+		jr := &jobRequest{
+			Env:    map[string]string{},
+			Params: map[string]string{},
+			client: client,
+		}
+		requests = append(requests, jr)
+		return jr
+	}
+
+	mediaType, mediaParams, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		items := []json.RawMessage{}
+		err = json.Unmarshal(bodyBytes, &items)
+		if err != nil {
+			return nil, &jobRequestError{"json", err.Error()}
+		}
+		for i, item := range items {
+			err = newRequest().unmarshal(item)
+			if err != nil {
+				return nil, batchItemError(i, err)
+			}
+		}
+	case "multipart/form-data":
+		mr := multipart.NewReader(bytes.NewReader(bodyBytes), mediaParams["boundary"])
+		for i := 0; ; i++ {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, &jobRequestError{"multipart", err.Error()}
+			}
+
+			partBytes, err := ioutil.ReadAll(part)
+			if err != nil {
+				return nil, &jobRequestError{"multipart", err.Error()}
+			}
+
+			jr := newRequest()
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if partType != "application/json" {
+				jr.Script = string(partBytes)
+				continue
+			}
+			err = jr.unmarshal(partBytes)
+			if err != nil {
+				return nil, batchItemError(i, err)
+			}
+		}
+	default:
+		return nil, &jobRequestError{"content_type", mediaType}
+	}
+
+	if len(requests) == 0 {
+		return nil, &jobRequestError{"jobs", "[]"}
+	}
+	return requests, nil
+}
+
+// batchItemError says which job in a batch an error is about
+func batchItemError(i int, err error) error {
+	switch e := err.(type) {
+	case *jobRequestError:
+		return &jobRequestError{fmt.Sprintf("jobs[%v].%v", i, e.name), e.value}
+	case *jobForbiddenError:
+		return &jobForbiddenError{fmt.Sprintf("jobs[%v]: %v", i, e.message)}
+	}
+	return err
+}
+
+// nextBatch hands out the group's next batch id, starting from 1
+func (g *jobGroup) nextBatch() int {
+	g.Lock()
+	defer g.Unlock()
+
+	g.batch++
+	return g.batch
+}
+
+// batchHref lists the jobs in a batch
+func (g *jobGroup) batchHref(batch int) string {
+	if g.name == "main" {
+		return fmt.Sprintf("/jobs?batch=%v", batch)
+	}
+	return fmt.Sprintf("/groups/%v/jobs?batch=%v", g.name, batch)
+}
+
+// Batch returns the jobs submitted together under a batch id
+func (g *jobGroup) Batch(batch int) []*job {
+	jobs := []*job{}
+	for _, j := range g.Getall("") {
+		if j.batch == batch {
+			jobs = append(jobs, j)
+		}
+	}
+	sort.Sort(jobsByID(jobs))
+	return jobs
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JobDependency is another job in the same group that a job runs after,
+// and on what condition: "success" (the default), "failure" or "always"
+type JobDependency struct {
+	ID int    `json:"id"`
+	On string `json:"on,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare job id
+func (d *JobDependency) UnmarshalJSON(data []byte) error {
+	var id int
+	if err := json.Unmarshal(data, &id); err == nil {
+		d.ID = id
+		return nil
+	}
+
+	type plain JobDependency
+	return json.Unmarshal(data, (*plain)(d))
+}
+
+// parseDependency reads "id" or "id:condition", as given in params
+func parseDependency(s string) (*JobDependency, error) {
+	parts := strings.SplitN(s, ":", 2)
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, &jobRequestError{"after", s}
+	}
+
+	d := &JobDependency{ID: id}
+	if len(parts) == 2 {
+		d.On = parts[1]
+	}
+	return d, nil
+}
+
+// check fills in the default condition and rejects unknown ones
+func (d *JobDependency) check() error {
+	switch d.On {
+	case "":
+		d.On = "success"
+	case "success", "failure", "always":
+	default:
+		return &jobRequestError{"after", fmt.Sprintf("%v:%v", d.ID, d.On)}
+	}
+	return nil
+}
+
+// satisfiedBy is true when the finished job meets the condition
+func (d *JobDependency) satisfiedBy(j *job) bool {
+	snap := j.snapshot()
+	succeeded := snap.state == "complete" && snap.status != nil && snap.status.Success
+	switch d.On {
+	case "failure":
+		return !succeeded
+	case "always":
+		return true
+	}
+	return succeeded
+}
+
+// dependencies looks up the jobs that j runs after, which must be in
+// the group already
+func (g *jobGroup) dependencies(j *job) ([]*job, error) {
+	deps := []*job{}
+	for _, d := range j.after {
+		dep := g.Get(d.ID)
+		if dep == nil {
+			return nil, &jobRequestError{"after", strconv.Itoa(d.ID)}
+		}
+		deps = append(deps, dep)
+	}
+	return deps, nil
+}
+
+// runWhenReady holds a blocked job until everything it runs after is
+// done, then runs it if all of their conditions are met or cancels it
+// if not
+func (g *jobGroup) runWhenReady(j *job, deps []*job) {
+	for _, dep := range deps {
+		select {
+		case <-dep.Done():
+		case <-j.Done():
+			return
+		case <-g.closed:
+			return
+		}
+	}
+
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	select {
+	case <-j.Done():
+		return
+	default:
+	}
+
+	for i, dep := range deps {
+		if !j.after[i].satisfiedBy(dep) {
+			g.cancel(j)
+			return
+		}
+	}
+
+	if runAt, _ := j.due(); runAt.After(time.Now()) {
+		j.setState("scheduled")
+		g.jobChanged(j, "scheduled")
+		go g.runWhenDue(j)
+		return
+	}
+	g.start(j)
+}
+
+// cancel finishes a job that will now never run
+func (g *jobGroup) cancel(j *job) {
+	j.end("cancelled")
+	g.jobChanged(j, "cancelled")
+}
+
+// graph is every job connected to j by dependencies, in either
+// direction, along with the dependencies between them
+func (g *jobGroup) graph(j *job) ([]*job, []*GraphEdge) {
+	all := g.Getall("")
+	dependents := map[int][]*job{}
+	for _, other := range all {
+		for _, d := range other.after {
+			dependents[d.ID] = append(dependents[d.ID], other)
+		}
+	}
+
+	seen := map[int]bool{j.id: true}
+	jobs := []*job{}
+	edges := []*GraphEdge{}
+	pending := []*job{j}
+	for len(pending) > 0 {
+		cur := pending[0]
+		pending = pending[1:]
+		jobs = append(jobs, cur)
+
+		next := dependents[cur.id]
+		for _, d := range cur.after {
+			edges = append(edges, &GraphEdge{From: d.ID, To: cur.id, On: d.On})
+			if dep := g.Get(d.ID); dep != nil {
+				next = append(next, dep)
+			}
+		}
+
+		for _, other := range next {
+			if !seen[other.id] {
+				seen[other.id] = true
+				pending = append(pending, other)
+			}
+		}
+	}
+
+	sort.Sort(jobsByID(jobs))
+	sort.Sort(edgesByJob(edges))
+	return jobs, edges
+}
+
+type jobsByID []*job
+
+func (s jobsByID) Len() int           { return len(s) }
+func (s jobsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s jobsByID) Less(i, j int) bool { return s[i].id < s[j].id }
+
+type edgesByJob []*GraphEdge
+
+func (s edgesByJob) Len() int      { return len(s) }
+func (s edgesByJob) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s edgesByJob) Less(i, j int) bool {
+	if s[i].To != s[j].To {
+		return s[i].To < s[j].To
+	}
+	return s[i].From < s[j].From
+}
+
+// GraphEdge means that the job To runs after the job From
+type GraphEdge struct {
+	From int    `json:"from"`
+	To   int    `json:"to"`
+	On   string `json:"on"`
+}
+
+// GraphResponse is the jobs connected to a job by dependencies
+type GraphResponse struct {
+	Jobs  []*JobJSON   `json:"jobs"`
+	Edges []*GraphEdge `json:"edges"`
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func waitForTestJob(t *testing.T, j *job) {
+	select {
+	case <-j.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("job %v never finished", j.id)
+	}
+}
+
+func TestJobGroupRunsJobsAfterDependencies(t *testing.T) {
+	g, err := NewJobGroup("deps-conditions", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+
+	after := func(id int, on string) *testJobOptions {
+		return &testJobOptions{after: []*JobDependency{{ID: id, On: on}}}
+	}
+
+	failing, _ := submitTestJob(t, g, "sleep 0.1 ; exit 1", nil)
+	onSuccess, _ := submitTestJob(t, g, "echo success", after(failing.id, ""))
+	onFailure, _ := submitTestJob(t, g, "echo failure", after(failing.id, "failure"))
+	always, _ := submitTestJob(t, g, "echo always", after(failing.id, "always"))
+	chained, _ := submitTestJob(t, g, "echo chained", after(onSuccess.id, "always"))
+
+	g.queue.Lock()
+	state := onSuccess.state
+	g.queue.Unlock()
+	if state != "blocked" {
+		t.Errorf("expected state blocked, got %v", state)
+	}
+
+	for _, j := range []*job{onSuccess, onFailure, always, chained} {
+		waitForTestJob(t, j)
+	}
+
+	for j, expected := range map[*job]string{
+		onSuccess: "cancelled",
+		onFailure: "complete",
+		always:    "complete",
+		chained:   "complete",
+	} {
+		if j.state != expected {
+			t.Errorf("job %v: expected %v, got %v", j.id, expected, j.state)
+		}
+	}
+
+	if onFailure.startTime.Before(failing.completeTime) {
+		t.Errorf("expected job %v to start after job %v completed", onFailure.id, failing.id)
+	}
+}
+
+func TestJobGroupRejectsUnknownDependencies(t *testing.T) {
+	g, err := NewJobGroup("deps-unknown", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+
+	j, err := newJob("echo never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.after = []*JobDependency{{ID: 42, On: "success"}}
+	if _, ok := g.Submit(j).(*jobRequestError); !ok {
+		t.Errorf("expected a jobRequestError")
+	}
+}
+
+func TestJobGroupGraph(t *testing.T) {
+	g, err := NewJobGroup("deps-graph", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+
+	build := &job{state: "complete", done: make(chan struct{})}
+	g.Add(build)
+	unrelated := &job{state: "complete", done: make(chan struct{})}
+	g.Add(unrelated)
+	test := &job{state: "blocked", after: []*JobDependency{{ID: build.id, On: "success"}}}
+	g.Add(test)
+	deploy := &job{state: "blocked", after: []*JobDependency{{ID: test.id, On: "success"}}}
+	g.Add(deploy)
+
+	jobs, edges := g.graph(test)
+	if len(jobs) != 3 || jobs[0] != build || jobs[1] != test || jobs[2] != deploy {
+		t.Errorf("unexpected graph jobs %v", jobs)
+	}
+	if len(edges) != 2 || edges[0].From != build.id || edges[1].To != deploy.id {
+		t.Errorf("unexpected graph edges %v", edges)
+	}
+}
@@ -2,18 +2,37 @@ package server
 
 import (
 	"fmt"
+	"path/filepath"
+	"sort"
 	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
 )
 
 var (
-	jobGroups      = map[string]*jobGroup{}
-	jobGroupsMutex sync.Mutex
-	errNoSuchJob   = fmt.Errorf("no such job")
+	jobGroups        = map[string]*jobGroup{}
+	jobGroupsMutex   sync.Mutex
+	errNoSuchJob     = fmt.Errorf("no such job")
+	errJobNotRunning = fmt.Errorf("job not running")
+	errJobDone       = fmt.Errorf("job is already done")
+	errGroupExists   = fmt.Errorf("job group already exists")
 )
 
 type jobGroup struct {
-	cur   int
-	store jobGroupStore
+	sync.Mutex
+	name       string
+	storeType  string
+	closed     chan struct{}
+	cur        int
+	batch      int
+	store      jobGroupStore
+	reapPolicy *reapPolicy
+	events     *eventHub
+	queue      jobQueue
+	schedules  scheduler
+	logger     *logrus.Logger
 }
 
 // GetJobGroup is how you get a job group, assuming it exists
@@ -29,29 +48,109 @@ func GetJobGroup(name string) *jobGroup {
 	return g
 }
 
-// NewJobGroup is used to initialize members of the jobGroups var
-func NewJobGroup(name, storeType string) (*jobGroup, error) {
-	var store jobGroupStore
+// NewJobGroup is used to initialize members of the jobGroups var.  The
+// stateDir is only used by store types that persist jobs, each group
+// getting its own subdirectory.  It returns errGroupExists rather than
+// replacing a group that's already there.
+func NewJobGroup(name, storeType, stateDir string) (*jobGroup, error) {
+	jobGroupsMutex.Lock()
+	defer jobGroupsMutex.Unlock()
+
+	if _, ok := jobGroups[name]; ok {
+		return nil, errGroupExists
+	}
+
+	var (
+		store jobGroupStore
+		err   error
+	)
 	switch storeType {
 	case "memory":
 		store = newMemoryJobGroupStore()
+	case "disk":
+		if stateDir == "" {
+			return nil, fmt.Errorf("storeType %v requires a state directory", storeType)
+		}
+		store, err = newDiskJobGroupStore(filepath.Join(stateDir, name))
+		if err != nil {
+			return nil, err
+		}
 	default:
 		return nil, fmt.Errorf("invalid storeType %v", storeType)
 	}
-	jobGroupsMutex.Lock()
-	defer jobGroupsMutex.Unlock()
+	batch := 0
+	for _, j := range store.Getall("") {
+		if j.batch > batch {
+			batch = j.batch
+		}
+	}
+
 	jobGroups[name] = &jobGroup{
-		store: store,
-		cur:   0,
+		batch:     batch,
+		name:      name,
+		storeType: storeType,
+		closed:    make(chan struct{}),
+		store:     store,
+		cur:       store.Cur(),
+		events:    newEventHub(),
+		schedules: scheduler{schedules: map[int]*schedule{}},
+		logger:    logrus.New(),
 	}
 	return jobGroups[name], nil
 }
 
+// AllJobGroups returns every job group, ordered by name
+func AllJobGroups() []*jobGroup {
+	jobGroupsMutex.Lock()
+	defer jobGroupsMutex.Unlock()
+
+	names := []string{}
+	for name := range jobGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := []*jobGroup{}
+	for _, name := range names {
+		groups = append(groups, jobGroups[name])
+	}
+	return groups
+}
+
+// RemoveJobGroup forgets a job group and stops its reaper, leaving its
+// jobs to whoever is still holding on to them
+func RemoveJobGroup(name string) bool {
+	jobGroupsMutex.Lock()
+	defer jobGroupsMutex.Unlock()
+
+	g, ok := jobGroups[name]
+	if !ok {
+		return false
+	}
+
+	close(g.closed)
+	delete(jobGroups, name)
+	return true
+}
+
+// Destroy forgets everything the group's store kept, for a deleted group
+func (g *jobGroup) Destroy() error {
+	g.schedules.Lock()
+	defer g.schedules.Unlock()
+
+	return g.store.Destroy()
+}
+
 func (g *jobGroup) Add(j *job) int {
+	g.Lock()
 	i := g.cur
 	j.id = i
-	g.store.Add(j)
+	j.group = g
 	g.cur += 1
+	g.Unlock()
+
+	g.store.Add(j)
+	g.events.Publish("created", j)
 	return i
 }
 
@@ -60,11 +159,64 @@ func (g *jobGroup) Get(i int) *job {
 }
 
 func (g *jobGroup) Kill(i int) error {
-	job := g.store.Get(i)
-	if job != nil {
-		return job.cmd.Process.Kill()
+	return g.Signal(i, syscall.SIGKILL)
+}
+
+// Signal sends sig to a running job's process group, keeping the job
+// around, or cancels a job that hasn't started yet.  Either way the job
+// ends up "killed" if it doesn't survive.
+func (g *jobGroup) Signal(i int, sig syscall.Signal) error {
+	j := g.store.Get(i)
+	if j == nil {
+		return errNoSuchJob
+	}
+
+	select {
+	case <-j.Done():
+		return errJobDone
+	default:
+	}
+
+	cancelled, err := j.Signal(sig)
+	if err != nil {
+		return err
+	}
+
+	if !cancelled {
+		return nil
+	}
+
+	g.dequeue(j)
+	j.end("killed")
+	g.jobChanged(j, "killed")
+	return nil
+}
+
+// Stop sends a job SIGTERM, following up with SIGKILL if it's still
+// going once its grace period is up
+func (g *jobGroup) Stop(i int) error {
+	err := g.Signal(i, syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+
+	j := g.store.Get(i)
+	if j == nil {
+		return nil
 	}
-	return errNoSuchJob
+
+	go func() {
+		timer := time.NewTimer(j.grace)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			g.Signal(i, syscall.SIGKILL)
+		case <-j.Done():
+		case <-g.closed:
+		}
+	}()
+	return nil
 }
 
 func (g *jobGroup) Getall(state string) []*job {
@@ -74,7 +226,41 @@ func (g *jobGroup) Getall(state string) []*job {
 func (g *jobGroup) Remove(i int) bool {
 	job := g.store.Get(i)
 	if job != nil {
+		g.dequeue(job)
 		job.Cleanup()
 	}
-	return g.store.Remove(i)
+	if !g.store.Remove(i) {
+		return false
+	}
+	g.events.Publish("deleted", job)
+	return true
+}
+
+func (g *jobGroup) jobChanged(j *job, eventType string) {
+	if err := g.store.Save(j); err != nil {
+		g.logger.WithFields(logrus.Fields{
+			"group": g.name,
+			"job":   j.id,
+			"err":   err,
+		}).Warn("Failed to save job")
+	}
+	g.events.Publish(eventType, j)
+}
+
+func (g *jobGroup) Href() string {
+	return fmt.Sprintf("/groups/%v", g.name)
+}
+
+func (g *jobGroup) toJSON() *jobGroupJSON {
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	return &jobGroupJSON{
+		Name:          g.name,
+		Store:         g.storeType,
+		MaxConcurrent: g.queue.maxConcurrent,
+		MaxQueue:      g.queue.maxLength,
+		Jobs:          len(g.Getall("")),
+		Href:          g.Href(),
+	}
 }
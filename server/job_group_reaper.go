@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// reapPolicy describes when completed jobs are garbage collected.  A
+// zero value for any limit disables that limit.
+type reapPolicy struct {
+	maxAge    time.Duration
+	maxJobs   int
+	maxOutput int64
+	interval  time.Duration
+}
+
+func (p *reapPolicy) enabled() bool {
+	return p != nil && (p.maxAge > 0 || p.maxJobs > 0 || p.maxOutput > 0)
+}
+
+func (p *reapPolicy) toMap() *map[string]string {
+	return &map[string]string{
+		"max_age":    p.maxAge.String(),
+		"max_jobs":   fmt.Sprintf("%v", p.maxJobs),
+		"max_output": fmt.Sprintf("%v", p.maxOutput),
+		"interval":   p.interval.String(),
+	}
+}
+
+type jobsByCompleteTime []*job
+
+func (s jobsByCompleteTime) Len() int           { return len(s) }
+func (s jobsByCompleteTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s jobsByCompleteTime) Less(i, j int) bool { return s[i].completed().Before(s[j].completed()) }
+
+// StartReaper periodically applies the reap policy in the background
+func (g *jobGroup) StartReaper(p *reapPolicy, logger *logrus.Logger) {
+	g.reapPolicy = p
+	if !p.enabled() || p.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				if n := g.Reap(now); n > 0 {
+					logger.WithFields(logrus.Fields{
+						"group": g.name,
+						"count": n,
+					}).Info("Reaped jobs")
+				}
+			case <-g.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Reap removes the completed jobs that fall outside of the reap policy,
+// oldest first, and returns how many were removed
+func (g *jobGroup) Reap(now time.Time) int {
+	p := g.reapPolicy
+	if !p.enabled() {
+		return 0
+	}
+
+	done := jobsByCompleteTime{}
+	for _, j := range g.Getall("") {
+		if j.isDone() {
+			done = append(done, j)
+		}
+	}
+	sort.Sort(done)
+
+	var totalOutput int64
+	for _, j := range done {
+		totalOutput += j.outputSize()
+	}
+
+	removed := 0
+	for _, j := range done {
+		remaining := len(done) - removed
+		expired := p.maxAge > 0 && now.Sub(j.completed()) > p.maxAge
+		tooMany := p.maxJobs > 0 && remaining > p.maxJobs
+		tooBig := p.maxOutput > 0 && totalOutput > p.maxOutput
+
+		if !expired && !tooMany && !tooBig {
+			break
+		}
+
+		totalOutput -= j.outputSize()
+		g.Remove(j.id)
+		removed++
+	}
+
+	return removed
+}
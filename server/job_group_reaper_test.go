@@ -0,0 +1,81 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func newReapTestGroup(t *testing.T, name string, p *reapPolicy, scripts ...string) *jobGroup {
+	g, err := NewJobGroup(name, "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.reapPolicy = p
+
+	for _, script := range scripts {
+		j, err := newJob(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Add(j)
+		j.Run()
+	}
+
+	return g
+}
+
+func TestReapRemovesExpiredJobs(t *testing.T) {
+	g := newReapTestGroup(t, "reap-age", &reapPolicy{maxAge: time.Minute},
+		"echo old", "echo new")
+	g.Get(0).completeTime = time.Now().Add(-time.Hour)
+
+	if n := g.Reap(time.Now()); n != 1 {
+		t.Errorf("expected 1 job reaped, got %v", n)
+	}
+
+	if g.Get(0) != nil || g.Get(1) == nil {
+		t.Errorf("expected only the old job to be reaped")
+	}
+}
+
+func TestReapKeepsMaxJobs(t *testing.T) {
+	g := newReapTestGroup(t, "reap-count", &reapPolicy{maxJobs: 2},
+		"echo 0", "echo 1", "echo 2")
+
+	if n := g.Reap(time.Now()); n != 1 {
+		t.Errorf("expected 1 job reaped, got %v", n)
+	}
+
+	if g.Get(0) != nil {
+		t.Errorf("expected the oldest job to be reaped")
+	}
+}
+
+func TestReapKeepsMaxOutput(t *testing.T) {
+	// each job's log takes a span on top of its output
+	g := newReapTestGroup(t, "reap-output", &reapPolicy{maxOutput: 2 * (6 + logSpanSize)},
+		"echo 12345", "echo 67890", "echo abcd")
+
+	if n := g.Reap(time.Now()); n != 1 {
+		t.Errorf("expected 1 job reaped, got %v", n)
+	}
+
+	if len(g.Getall("complete")) != 2 {
+		t.Errorf("expected 2 jobs to remain")
+	}
+}
+
+func TestReapIgnoresUnfinishedJobs(t *testing.T) {
+	g := newReapTestGroup(t, "reap-unfinished", &reapPolicy{maxJobs: 1})
+	for i := 0; i < 2; i++ {
+		j, err := newJob("echo waiting")
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Add(j)
+	}
+
+	if n := g.Reap(time.Now()); n != 0 {
+		t.Errorf("expected no jobs reaped, got %v", n)
+	}
+}
@@ -0,0 +1,22 @@
+package server
+
+type jobGroupJSON struct {
+	Name          string `json:"name"`
+	Store         string `json:"store"`
+	MaxConcurrent int    `json:"max_concurrent"`
+	MaxQueue      int    `json:"max_queue"`
+	Jobs          int    `json:"jobs"`
+	Href          string `json:"href"`
+}
+
+type jobGroupResponse struct {
+	Groups []*jobGroupJSON `json:"groups"`
+}
+
+func newJobGroupResponse(groups []*jobGroup) *jobGroupResponse {
+	mapped := []*jobGroupJSON{}
+	for _, g := range groups {
+		mapped = append(mapped, g.toJSON())
+	}
+	return &jobGroupResponse{Groups: mapped}
+}
@@ -5,4 +5,13 @@ type jobGroupStore interface {
 	Get(int) *job
 	Getall(string) []*job
 	Remove(int) bool
+	// Save is called whenever a job's state changes
+	Save(*job) error
+	// Cur is the next job id that has never been handed out
+	Cur() int
+	// SaveSchedules is called whenever the group's schedules change
+	SaveSchedules([]*schedule) error
+	LoadSchedules() ([]*schedule, error)
+	// Destroy forgets everything the store kept, once its group is deleted
+	Destroy() error
 }
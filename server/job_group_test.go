@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestNewJobGroupCreatesEachNameOnce(t *testing.T) {
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := NewJobGroup("create-once", "memory", "")
+			errs <- err
+		}()
+	}
+	defer RemoveJobGroup("create-once")
+
+	created := 0
+	for i := 0; i < 10; i++ {
+		switch err := <-errs; err {
+		case nil:
+			created++
+		case errGroupExists:
+		default:
+			t.Error(err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("expected the group to be created once, got %v", created)
+	}
+}
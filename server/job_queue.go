@@ -0,0 +1,395 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull       = fmt.Errorf("job queue is full")
+	errJobNotScheduled = fmt.Errorf("job is not scheduled")
+)
+
+// jobQueue limits how many of a job group's jobs run at once.  Jobs
+// beyond the limit wait in priority order, first come first served among
+// equal priorities.  A zero maxConcurrent or maxLength means no limit.
+type jobQueue struct {
+	sync.Mutex
+	maxConcurrent int
+	maxLength     int
+	running       int
+	seq           int
+	waiting       []*queuedJob
+}
+
+// queuedJob is a job waiting for its turn.  A job queued for another
+// attempt is already running, and its resume channel is closed when its
+// turn comes rather than starting it.
+type queuedJob struct {
+	j      *job
+	seq    int
+	resume chan struct{}
+}
+
+func (q *jobQueue) canStart() bool {
+	return q.maxConcurrent <= 0 || q.running < q.maxConcurrent
+}
+
+func (q *jobQueue) full() bool {
+	return q.maxLength > 0 && len(q.waiting) >= q.maxLength
+}
+
+// push must be called with the lock held
+func (q *jobQueue) push(j *job) {
+	q.pushResume(j, nil)
+}
+
+// pushResume must be called with the lock held
+func (q *jobQueue) pushResume(j *job, resume chan struct{}) {
+	q.waiting = append(q.waiting, &queuedJob{j: j, seq: q.seq, resume: resume})
+	q.seq++
+	sort.Sort(byPriority(q.waiting))
+}
+
+// pop must be called with the lock held
+func (q *jobQueue) pop() *queuedJob {
+	if len(q.waiting) == 0 {
+		return nil
+	}
+	qj := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	return qj
+}
+
+// remove must be called with the lock held
+func (q *jobQueue) remove(j *job) bool {
+	for i, qj := range q.waiting {
+		if qj.j == j {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// position is 1 for the next job to run, or 0 if the job isn't waiting
+func (q *jobQueue) position(j *job) int {
+	q.Lock()
+	defer q.Unlock()
+
+	for i, qj := range q.waiting {
+		if qj.j == j {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+type byPriority []*queuedJob
+
+func (s byPriority) Len() int      { return len(s) }
+func (s byPriority) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPriority) Less(i, j int) bool {
+	if s[i].j.priority != s[j].j.priority {
+		return s[i].j.priority > s[j].j.priority
+	}
+	return s[i].seq < s[j].seq
+}
+
+// SetLimits changes how many jobs may run at once and how many may wait
+func (g *jobGroup) SetLimits(maxConcurrent, maxQueue int) {
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	g.queue.maxConcurrent = maxConcurrent
+	g.queue.maxLength = maxQueue
+	g.startQueued()
+}
+
+// Submit adds a job to the group and runs it as soon as the group's
+// concurrency limit allows, returning errQueueFull if it can't wait.
+// Jobs with a run time in the future are "scheduled" until then, and
+// only queue once they're due.  Jobs that run after others are
+// "blocked" until those are done.
+func (g *jobGroup) Submit(j *job) error {
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	return g.submit(j)
+}
+
+// SubmitBatch submits every job or, if any of them can't be, none of
+// them
+func (g *jobGroup) SubmitBatch(jobs []*job) error {
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	now := 0
+	for _, j := range jobs {
+		if _, err := g.dependencies(j); err != nil {
+			return err
+		}
+		if runAt, _ := j.due(); len(j.after) == 0 && !runAt.After(time.Now()) {
+			now++
+		}
+	}
+
+	if g.queue.maxConcurrent > 0 && g.queue.maxLength > 0 {
+		toQueue := now - (g.queue.maxConcurrent - g.queue.running)
+		if toQueue > 0 && len(g.queue.waiting)+toQueue > g.queue.maxLength {
+			return errQueueFull
+		}
+	}
+
+	for _, j := range jobs {
+		if err := g.submit(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submit must be called with the queue lock held
+func (g *jobGroup) submit(j *job) error {
+	var deps []*job
+	if len(j.after) > 0 {
+		var err error
+		deps, err = g.dependencies(j)
+		if err != nil {
+			return err
+		}
+	} else if runAt, _ := j.due(); !runAt.After(time.Now()) && !g.queue.canStart() && g.queue.full() {
+		return errQueueFull
+	}
+
+	g.Add(j)
+	g.release(j, deps)
+	return nil
+}
+
+// release runs a job that has been added to the group, or holds it until
+// it's due or the jobs it runs after are done.  It must be called with
+// the queue lock held.
+func (g *jobGroup) release(j *job, deps []*job) {
+	if len(j.after) > 0 {
+		j.setState("blocked")
+		g.jobChanged(j, "blocked")
+		go g.runWhenReady(j, deps)
+		return
+	}
+
+	if runAt, _ := j.due(); runAt.After(time.Now()) {
+		j.setState("scheduled")
+		g.jobChanged(j, "scheduled")
+		go g.runWhenDue(j)
+		return
+	}
+
+	g.start(j)
+}
+
+// Start has the group log through the server's logger and resubmits the
+// jobs its store had waiting to run when the server last stopped, in the
+// order they were created.  A job whose dependencies have since been
+// removed is cancelled.  The output of the store's other jobs is kept to
+// the server's output limits.
+func (g *jobGroup) Start(c *serverContext) {
+	g.logger = c.logger
+
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	pending := []*job{}
+	for _, j := range g.Getall("") {
+		if j.group != nil {
+			continue
+		}
+		if j.isDone() {
+			j.outBuf.setLimits(c.outputLimits)
+			j.errBuf.setLimits(c.outputLimits)
+		} else if !j.hasStarted() {
+			pending = append(pending, j)
+		}
+	}
+	sort.Sort(jobsByID(pending))
+
+	for _, j := range pending {
+		j.group = g
+		j.grace = c.killGrace
+		j.cmd.Env, j.envKeys = jobEnv(c.env, j.cleanEnv, j.envExtra)
+		limits := c.outputLimits
+		if j.limits.max > 0 && (limits.max <= 0 || j.limits.max < limits.max) {
+			limits.max = j.limits.max
+		}
+		j.setOutputLimits(limits)
+
+		deps, err := g.dependencies(j)
+		if err != nil {
+			g.cancel(j)
+			continue
+		}
+		g.release(j, deps)
+	}
+}
+
+// start runs a job now or queues it, and must be called with the queue
+// lock held
+func (g *jobGroup) start(j *job) {
+	if g.queue.canStart() {
+		g.queue.running++
+		go g.run(j)
+		return
+	}
+
+	j.setState("queued")
+	g.queue.push(j)
+	g.jobChanged(j, "queued")
+}
+
+// runWhenDue waits for a scheduled job's run time, which may change
+// while it waits, and then starts it regardless of how many jobs are
+// already queued
+func (g *jobGroup) runWhenDue(j *job) {
+	for {
+		runAt, changed := j.due()
+		timer := time.NewTimer(time.Until(runAt))
+
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+			continue
+		case <-j.Done():
+			timer.Stop()
+			return
+		case <-g.closed:
+			timer.Stop()
+			return
+		}
+
+		g.queue.Lock()
+		if runAt, _ := j.due(); runAt.After(time.Now()) {
+			g.queue.Unlock()
+			continue
+		}
+		select {
+		case <-j.Done():
+		default:
+			g.start(j)
+		}
+		g.queue.Unlock()
+		return
+	}
+}
+
+// Reschedule changes when a scheduled job will run
+func (g *jobGroup) Reschedule(i int, runAt time.Time) error {
+	j := g.store.Get(i)
+	if j == nil {
+		return errNoSuchJob
+	}
+
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	if j.currentState() != "scheduled" {
+		return errJobNotScheduled
+	}
+	j.setRunAt(runAt)
+	g.jobChanged(j, "rescheduled")
+	return nil
+}
+
+func (g *jobGroup) run(j *job) {
+	j.run(g)
+
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	g.queue.running--
+	g.startQueued()
+}
+
+// startQueued must be called with the queue lock held
+func (g *jobGroup) startQueued() {
+	for g.queue.canStart() {
+		qj := g.queue.pop()
+		if qj == nil {
+			return
+		}
+		g.queue.running++
+		if qj.resume != nil {
+			close(qj.resume)
+			continue
+		}
+		go g.run(qj.j)
+	}
+}
+
+// pauseRetry gives up a retrying job's place among the running jobs
+// while it waits to try again, so that it doesn't hold up the queue
+func (g *jobGroup) pauseRetry() {
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	g.queue.running--
+	g.startQueued()
+}
+
+// resumeRetry gets a retrying job its place among the running jobs back,
+// queueing it like any other job if there isn't one free.  A job that
+// was signalled while it waited gets its place straight away, just to
+// finish up in.  It's false if the job was cancelled while queued.
+// Either way the job ends up counted as running, as run gives up its
+// place once the job is done.
+func (g *jobGroup) resumeRetry(j *job) bool {
+	g.queue.Lock()
+	if j.signalled() != "" || g.queue.canStart() {
+		g.queue.running++
+		g.queue.Unlock()
+		return true
+	}
+
+	resume := make(chan struct{})
+	j.setState("queued")
+	g.queue.pushResume(j, resume)
+	g.jobChanged(j, "queued")
+	g.queue.Unlock()
+
+	select {
+	case <-resume:
+		return true
+	case <-j.Done():
+	}
+
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	select {
+	case <-resume:
+		// its turn came just as it was cancelled
+	default:
+		g.queue.remove(j)
+		g.queue.running++
+	}
+	return false
+}
+
+// dequeue forgets a job that hasn't started yet
+func (g *jobGroup) dequeue(j *job) bool {
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	return g.queue.remove(j)
+}
+
+// dequeueAll forgets every job that hasn't started yet so that none
+// start while the group is being torn down
+func (g *jobGroup) dequeueAll() {
+	g.queue.Lock()
+	defer g.queue.Unlock()
+
+	g.queue.waiting = nil
+}
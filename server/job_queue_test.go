@@ -0,0 +1,271 @@
+package server
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testJobOptions set up a test job the way a job request would
+type testJobOptions struct {
+	priority int
+	after    []*JobDependency
+	retry    *RetryPolicy
+}
+
+func newTestJob(t *testing.T, script string, opts *testJobOptions) *job {
+	j, err := newJob(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts == nil {
+		return j
+	}
+
+	j.priority = opts.priority
+	for _, d := range opts.after {
+		if err := d.check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.after = opts.after
+	if opts.retry != nil {
+		j.retry, err = opts.retry.parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return j
+}
+
+func submitTestJob(t *testing.T, g *jobGroup, script string, opts *testJobOptions) (*job, error) {
+	j := newTestJob(t, script, opts)
+	return j, g.Submit(j)
+}
+
+// waitForCompletions returns the ids of the next n jobs to complete, in
+// the order they completed
+func waitForCompletions(t *testing.T, sub *eventSubscription, n int) []int {
+	ids := []int{}
+	for len(ids) < n {
+		select {
+		case e := <-sub.events:
+			ids = append(ids, e.JobID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %v of %v jobs completed", len(ids), n)
+		}
+	}
+	return ids
+}
+
+func TestJobGroupSubmitQueuesBeyondLimit(t *testing.T) {
+	g, err := NewJobGroup("queue-limit", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetLimits(1, 1)
+
+	sub := g.events.Subscribe(&eventFilter{states: map[string]bool{"complete": true}})
+	defer g.events.Unsubscribe(sub)
+
+	submitTestJob(t, g, "sleep 0.2", nil)
+	second, err := submitTestJob(t, g, "echo second", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pos := g.queue.position(second); pos != 1 {
+		t.Errorf("expected queue position 1, got %v", pos)
+	}
+
+	if _, err := submitTestJob(t, g, "echo third", nil); err != errQueueFull {
+		t.Errorf("expected errQueueFull, got %v", err)
+	}
+
+	waitForCompletions(t, sub, 2)
+}
+
+func TestJobGroupSubmitRunsHigherPriorityFirst(t *testing.T) {
+	g, err := NewJobGroup("queue-priority", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetLimits(1, 0)
+
+	sub := g.events.Subscribe(&eventFilter{states: map[string]bool{"complete": true}})
+	defer g.events.Unsubscribe(sub)
+
+	first, _ := submitTestJob(t, g, "sleep 0.2", nil)
+	low, _ := submitTestJob(t, g, "echo low", nil)
+	high, _ := submitTestJob(t, g, "echo high", &testJobOptions{priority: 5})
+
+	if pos := g.queue.position(high); pos != 1 {
+		t.Errorf("expected high priority job first in line, got %v", pos)
+	}
+
+	if pos := g.queue.position(low); pos != 2 {
+		t.Errorf("expected low priority job second in line, got %v", pos)
+	}
+
+	ids := waitForCompletions(t, sub, 3)
+	if ids[0] != first.id || ids[1] != high.id || ids[2] != low.id {
+		t.Errorf("expected jobs to complete in priority order, got %v", ids)
+	}
+}
+
+func TestJobGroupSignalCancelsQueuedJobs(t *testing.T) {
+	g, err := NewJobGroup("queue-cancel", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetLimits(1, 0)
+
+	sub := g.events.Subscribe(&eventFilter{states: map[string]bool{"complete": true}})
+	defer g.events.Unsubscribe(sub)
+
+	first, _ := submitTestJob(t, g, "sleep 0.2", nil)
+	queued, _ := submitTestJob(t, g, "echo never", nil)
+
+	if err := g.Signal(queued.id, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+
+	if queued.state != "killed" || queued.signalled() != "SIGKILL" {
+		t.Errorf("expected queued job to be cancelled, got %v", queued.state)
+	}
+	if pos := g.queue.position(queued); pos != 0 {
+		t.Errorf("expected cancelled job out of the queue, got position %v", pos)
+	}
+
+	if ids := waitForCompletions(t, sub, 1); ids[0] != first.id {
+		t.Errorf("expected only the first job to complete, got %v", ids)
+	}
+	if queued.outBuf.String() != "" || !queued.startTime.IsZero() {
+		t.Errorf("expected cancelled job never to run")
+	}
+}
+
+func TestJobGroupSignalLeavesQueuedJobsForOtherSignals(t *testing.T) {
+	g, err := NewJobGroup("queue-hup", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetLimits(1, 0)
+
+	sub := g.events.Subscribe(&eventFilter{states: map[string]bool{"complete": true}})
+	defer g.events.Unsubscribe(sub)
+
+	submitTestJob(t, g, "sleep 0.2", nil)
+	queued, _ := submitTestJob(t, g, "echo later", nil)
+
+	if err := g.Signal(queued.id, syscall.SIGHUP); err != errJobNotRunning {
+		t.Errorf("expected errJobNotRunning, got %v", err)
+	}
+	if queued.currentState() != "queued" || queued.signalled() != "" {
+		t.Errorf("expected queued job to be left alone, got %v", queued.currentState())
+	}
+
+	waitForCompletions(t, sub, 2)
+	if queued.outBuf.String() != "later\n" {
+		t.Errorf("expected queued job to run, got %q", queued.outBuf.String())
+	}
+}
+
+func TestJobGroupSubmitHoldsScheduledJobs(t *testing.T) {
+	g, err := NewJobGroup("queue-scheduled", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+
+	j, err := newJob("echo later")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.setRunAt(time.Now().Add(time.Hour))
+	if err = g.Submit(j); err != nil {
+		t.Fatal(err)
+	}
+
+	g.queue.Lock()
+	state := j.state
+	g.queue.Unlock()
+	if state != "scheduled" {
+		t.Fatalf("expected state scheduled, got %v", state)
+	}
+
+	err = g.Reschedule(j.id, time.Now().Add(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-j.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("rescheduled job never ran")
+	}
+	if j.state != "complete" || j.startTime.Before(j.createTime.Add(50*time.Millisecond)) {
+		t.Errorf("unexpected state %v starting at %v", j.state, j.startTime)
+	}
+
+	if err = g.Reschedule(j.id, time.Now()); err != errJobNotScheduled {
+		t.Errorf("expected errJobNotScheduled, got %v", err)
+	}
+}
+
+func TestJobGroupSignalCancelsScheduledJobs(t *testing.T) {
+	g, err := NewJobGroup("queue-scheduled-cancel", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+
+	j, err := newJob("echo never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.setRunAt(time.Now().Add(time.Hour))
+	g.Submit(j)
+
+	if err = g.Kill(j.id); err != nil {
+		t.Fatal(err)
+	}
+
+	<-j.Done()
+	if j.state != "killed" || j.hasStarted() {
+		t.Errorf("expected an unstarted killed job, got %v", j.state)
+	}
+}
+
+func TestJobGroupSubmitBatchIsAllOrNothing(t *testing.T) {
+	g, err := NewJobGroup("queue-batch", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+	g.SetLimits(1, 1)
+
+	batch := []*job{}
+	for _, script := range []string{"sleep 0.2", "echo second", "echo third"} {
+		j, err := newJob(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch = append(batch, j)
+	}
+
+	if err = g.SubmitBatch(batch); err != errQueueFull {
+		t.Errorf("expected errQueueFull, got %v", err)
+	}
+	if n := len(g.Getall("")); n != 0 {
+		t.Errorf("expected no jobs to be submitted, got %v", n)
+	}
+
+	sub := g.events.Subscribe(&eventFilter{states: map[string]bool{"complete": true}})
+	defer g.events.Unsubscribe(sub)
+
+	if err = g.SubmitBatch(batch[:2]); err != nil {
+		t.Fatal(err)
+	}
+	waitForCompletions(t, sub, 2)
+}
@@ -0,0 +1,524 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// jobRequest is everything that may be given when creating a job.  It
+// is either POSTed as a JSON envelope with a Content-Type of
+// application/json, as multipart/form-data with "script" and "stdin"
+// parts (and optionally a "request" part holding a JSON envelope), or
+// built from a plain script body, along with query parameters and
+// Rtot-* headers.  Requests for a catalog command give its params
+// rather than a script.
+type jobRequest struct {
+	Script   string            `json:"script"`
+	Env      map[string]string `json:"env,omitempty"`
+	CleanEnv bool              `json:"clean_env,omitempty"`
+	Dir      string            `json:"dir,omitempty"`
+	Timeout  string            `json:"timeout,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+	User     string            `json:"user,omitempty"`
+	Group    string            `json:"group,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+
+	Stdin     string `json:"stdin,omitempty"`
+	StdinOpen bool   `json:"stdin_open,omitempty"`
+
+	OutputMax int64 `json:"output_max,omitempty"`
+	Log       bool  `json:"log,omitempty"`
+
+	RunAt string `json:"run_at,omitempty"`
+	Delay string `json:"delay,omitempty"`
+
+	After []*JobDependency `json:"after,omitempty"`
+
+	Retry *RetryPolicy `json:"retry,omitempty"`
+
+	client  string
+	owner   string
+	command *command
+}
+
+// jobRequestError means the client asked for something invalid
+type jobRequestError struct {
+	name  string
+	value string
+}
+
+func (e *jobRequestError) Error() string {
+	return fmt.Sprintf("invalid %v %q", e.name, e.value)
+}
+
+// jobForbiddenError means the client asked for something the server
+// isn't willing to do
+type jobForbiddenError struct {
+	message string
+}
+
+func (e *jobForbiddenError) Error() string {
+	return e.message
+}
+
+func newJobRequest(req *http.Request) (*jobRequest, error) {
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	jr := &jobRequest{
+		Env:    map[string]string{},
+		Params: map[string]string{},
+		client: clientSubject(req),
+	}
+
+	mediaType, mediaParams, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		err = jr.unmarshal(bodyBytes)
+		if err != nil {
+			return nil, err
+		}
+	case "multipart/form-data":
+		err = jr.readParts(multipart.NewReader(bytes.NewReader(bodyBytes), mediaParams["boundary"]))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		jr.Script = string(bodyBytes)
+	}
+
+	query := req.URL.Query()
+	if jr.Timeout == "" {
+		jr.Timeout = queryOrHeader(req, "timeout", "Rtot-Timeout")
+	}
+
+	if priorityString := queryOrHeader(req, "priority", "Rtot-Priority"); priorityString != "" {
+		jr.Priority, err = strconv.Atoi(priorityString)
+		if err != nil {
+			return nil, &jobRequestError{"priority", priorityString}
+		}
+	}
+
+	if jr.Dir == "" {
+		jr.Dir = queryOrHeader(req, "dir", "Rtot-Dir")
+	}
+
+	if jr.User == "" {
+		jr.User = queryOrHeader(req, "user", "Rtot-User")
+	}
+
+	if jr.RunAt == "" {
+		jr.RunAt = queryOrHeader(req, "run_at", "Rtot-Run-At")
+	}
+
+	if jr.Delay == "" {
+		jr.Delay = queryOrHeader(req, "delay", "Rtot-Delay")
+	}
+
+	if jr.Group == "" {
+		jr.Group = queryOrHeader(req, "group", "Rtot-Group")
+	}
+
+	if retryString := queryOrHeader(req, "retry", "Rtot-Retry"); retryString != "" && jr.Retry == nil {
+		maxAttempts, err := strconv.Atoi(retryString)
+		if err != nil {
+			return nil, &jobRequestError{"retry", retryString}
+		}
+		jr.Retry = &RetryPolicy{MaxAttempts: maxAttempts}
+	}
+
+	if cleanEnvString := queryOrHeader(req, "clean_env", "Rtot-Clean-Env"); cleanEnvString != "" {
+		jr.CleanEnv, err = strconv.ParseBool(cleanEnvString)
+		if err != nil {
+			return nil, &jobRequestError{"clean_env", cleanEnvString}
+		}
+	}
+
+	for _, pair := range append(query["env"], req.Header["Rtot-Env"]...) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, &jobRequestError{"env", pair}
+		}
+		jr.Env[parts[0]] = parts[1]
+	}
+
+	if outputMaxString := queryOrHeader(req, "output_max", "Rtot-Output-Max"); outputMaxString != "" {
+		jr.OutputMax, err = strconv.ParseInt(outputMaxString, 10, 64)
+		if err != nil || jr.OutputMax < 0 {
+			return nil, &jobRequestError{"output_max", outputMaxString}
+		}
+	}
+
+	if logString := queryOrHeader(req, "log", "Rtot-Log"); logString != "" {
+		jr.Log, err = strconv.ParseBool(logString)
+		if err != nil {
+			return nil, &jobRequestError{"log", logString}
+		}
+	}
+
+	if stdinOpenString := queryOrHeader(req, "stdin_open", "Rtot-Stdin-Open"); stdinOpenString != "" {
+		jr.StdinOpen, err = strconv.ParseBool(stdinOpenString)
+		if err != nil {
+			return nil, &jobRequestError{"stdin_open", stdinOpenString}
+		}
+	}
+
+	for _, list := range append(query["after"], req.Header["Rtot-After"]...) {
+		for _, item := range strings.Split(list, ",") {
+			d, err := parseDependency(strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			jr.After = append(jr.After, d)
+		}
+	}
+
+	for _, pair := range append(query["param"], req.Header["Rtot-Param"]...) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, &jobRequestError{"param", pair}
+		}
+		jr.Params[parts[0]] = parts[1]
+	}
+
+	return jr, nil
+}
+
+func (jr *jobRequest) unmarshal(jsonBytes []byte) error {
+	err := json.Unmarshal(jsonBytes, jr)
+	if err != nil {
+		return &jobRequestError{"json", err.Error()}
+	}
+	if jr.Env == nil {
+		jr.Env = map[string]string{}
+	}
+	if jr.Params == nil {
+		jr.Params = map[string]string{}
+	}
+	return nil
+}
+
+// readParts fills in the request from a multipart body, ignoring any
+// parts it doesn't know about
+func (jr *jobRequest) readParts(mr *multipart.Reader) error {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &jobRequestError{"multipart", err.Error()}
+		}
+
+		partBytes, err := ioutil.ReadAll(part)
+		if err != nil {
+			return &jobRequestError{"multipart", err.Error()}
+		}
+
+		switch part.FormName() {
+		case "request":
+			err = jr.unmarshal(partBytes)
+			if err != nil {
+				return err
+			}
+		case "script":
+			jr.Script = string(partBytes)
+		case "stdin":
+			jr.Stdin = string(partBytes)
+		}
+	}
+}
+
+// jobEnv is the base environment, or none for a clean one, with extra
+// added over it, along with its sorted keys
+func jobEnv(base []string, clean bool, extra map[string]string) ([]string, []string) {
+	envMap := map[string]string{}
+	if !clean {
+		for _, pair := range base {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) == 2 {
+				envMap[parts[0]] = parts[1]
+			}
+		}
+	}
+	for key, value := range extra {
+		envMap[key] = value
+	}
+
+	envKeys := []string{}
+	for key := range envMap {
+		envKeys = append(envKeys, key)
+	}
+	sort.Strings(envKeys)
+
+	env := []string{}
+	for _, key := range envKeys {
+		env = append(env, key+"="+envMap[key])
+	}
+	return env, envKeys
+}
+
+// newJob builds the job described by the request, with the server's own
+// environment as the base environment unless a clean one was requested.
+// Env params of catalog commands override anything else in the
+// environment.
+func (jr *jobRequest) newJob(c *serverContext) (*job, error) {
+	timeout := c.jobTimeout
+	if jr.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(jr.Timeout)
+		if err != nil || timeout < 0 {
+			return nil, &jobRequestError{"timeout", jr.Timeout}
+		}
+	}
+
+	dir := jr.Dir
+	if dir == "" {
+		var err error
+		dir, err = os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil, &jobRequestError{"dir", dir}
+	}
+
+	envExtra := map[string]string{}
+	for key, value := range jr.Env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return nil, &jobRequestError{"env", key}
+		}
+		envExtra[key] = value
+	}
+
+	var args []string
+	if jr.command != nil {
+		if len(jr.Env) > 0 {
+			return nil, &jobForbiddenError{"catalog commands take params, not env"}
+		}
+
+		var (
+			params map[string]string
+			err    error
+		)
+		args, params, err = jr.command.resolve(jr.Params)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range params {
+			envExtra[key] = value
+		}
+	}
+	env, envKeys := jobEnv(c.env, jr.CleanEnv, envExtra)
+
+	credential, err := jr.credential(c)
+	if err != nil {
+		return nil, err
+	}
+
+	runAt, err := parseRunAt(jr.RunAt, jr.Delay)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range jr.After {
+		if err := d.check(); err != nil {
+			return nil, err
+		}
+	}
+
+	var retry *retryPolicy
+	if jr.Retry != nil {
+		if jr.StdinOpen {
+			return nil, &jobForbiddenError{"jobs with open stdin can't be retried"}
+		}
+		retry, err = jr.Retry.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	limits := c.outputLimits
+	if jr.OutputMax > 0 {
+		if limits.max > 0 && jr.OutputMax > limits.max {
+			return nil, &jobForbiddenError{fmt.Sprintf("output_max may be at most %v", limits.max)}
+		}
+		limits.max = jr.OutputMax
+	}
+
+	var j *job
+	if jr.command != nil {
+		j = newCommandJob(jr.command.Name, jr.command.filename, args)
+	} else {
+		j, err = newJob(jr.Script)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	j.timeout = timeout
+	j.grace = c.killGrace
+	j.priority = jr.Priority
+	j.dir = dir
+	j.envKeys = envKeys
+	j.envExtra = envExtra
+	j.cleanEnv = jr.CleanEnv
+	j.client = jr.client
+	j.owner = jr.owner
+	j.cmd.Dir = dir
+	j.cmd.Env = env
+	if jr.Log {
+		j.recordLog()
+	}
+	j.setOutputLimits(limits)
+	if !runAt.IsZero() {
+		j.setRunAt(runAt)
+	}
+	j.after = jr.After
+	j.retry = retry
+
+	if jr.StdinOpen {
+		err = j.openStdin([]byte(jr.Stdin))
+		if err != nil {
+			j.Cleanup()
+			return nil, err
+		}
+	} else if jr.Stdin != "" {
+		j.stdinData = jr.Stdin
+		j.cmd.Stdin = strings.NewReader(jr.Stdin)
+	}
+
+	if credential != nil {
+		j.user = jr.User
+		j.groupName = jr.Group
+		j.cmd.SysProcAttr.Credential = credential
+	}
+
+	return j, nil
+}
+
+// parseRunAt is when a job should run given either an RFC 3339 time or
+// a delay from now, or the zero time for right away
+func parseRunAt(runAt, delay string) (time.Time, error) {
+	switch {
+	case runAt != "" && delay != "":
+		return time.Time{}, &jobRequestError{"delay", delay}
+	case runAt != "":
+		t, err := time.Parse(time.RFC3339, runAt)
+		if err != nil {
+			return time.Time{}, &jobRequestError{"run_at", runAt}
+		}
+		return t, nil
+	case delay != "":
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return time.Time{}, &jobRequestError{"delay", delay}
+		}
+		return time.Now().Add(d), nil
+	}
+	return time.Time{}, nil
+}
+
+// credential resolves the requested user and group, if any, checking
+// them against the server's allowed users and groups.  A user on its own
+// runs with that user's primary group, and a group on its own runs as
+// rtot's own user.  Either way the job keeps the supplementary groups of
+// the user it runs as.
+func (jr *jobRequest) credential(c *serverContext) (*syscall.Credential, error) {
+	if jr.User == "" && jr.Group == "" {
+		return nil, nil
+	}
+
+	if jr.User != "" && !listContains(c.allowedUsers, jr.User) {
+		return nil, &jobForbiddenError{fmt.Sprintf("user %q is not allowed", jr.User)}
+	}
+
+	if jr.Group != "" && !listContains(c.allowedGroups, jr.Group) {
+		return nil, &jobForbiddenError{fmt.Sprintf("group %q is not allowed", jr.Group)}
+	}
+
+	uidString := strconv.Itoa(os.Getuid())
+	gidString := strconv.Itoa(os.Getgid())
+
+	var groups []uint32
+	if jr.User != "" {
+		u, err := user.Lookup(jr.User)
+		if err != nil {
+			return nil, &jobRequestError{"user", jr.User}
+		}
+		uidString, gidString = u.Uid, u.Gid
+
+		groupIds, err := u.GroupIds()
+		if err != nil {
+			return nil, err
+		}
+		for _, groupId := range groupIds {
+			gid, err := strconv.ParseUint(groupId, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, uint32(gid))
+		}
+	} else {
+		gids, err := os.Getgroups()
+		if err != nil {
+			return nil, err
+		}
+		for _, gid := range gids {
+			groups = append(groups, uint32(gid))
+		}
+	}
+
+	if jr.Group != "" {
+		g, err := user.LookupGroup(jr.Group)
+		if err != nil {
+			return nil, &jobRequestError{"group", jr.Group}
+		}
+		gidString = g.Gid
+	}
+
+	uid, err := strconv.ParseUint(uidString, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	gid, err := strconv.ParseUint(gidString, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, nil
+}
+
+// listContains checks for item in a comma-separated list
+func listContains(list, item string) bool {
+	for _, part := range strings.Split(list, ",") {
+		if strings.TrimSpace(part) == item {
+			return true
+		}
+	}
+	return false
+}
+
+func queryOrHeader(req *http.Request, param, header string) string {
+	if value := req.URL.Query().Get(param); value != "" {
+		return value
+	}
+	return req.Header.Get(header)
+}
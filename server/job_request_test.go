@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestJobRequest(t *testing.T, ctype, path, body string) *jobRequest {
+	req, err := http.NewRequest("POST", path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", ctype)
+
+	jr, err := newJobRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jr
+}
+
+func TestJobRequestFromJSONEnvelope(t *testing.T) {
+	jr := newTestJobRequest(t, "application/json", "/jobs",
+		`{"script": "pwd ; echo $FOO", "env": {"FOO": "bar"}, "clean_env": true, "dir": "/"}`)
+
+	c := &serverContext{env: []string{"INHERITED=yes"}}
+	j, err := jr.newJob(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j.Run()
+	if j.outBuf.String() != "/\nbar\n" {
+		t.Errorf("unexpected output %q", j.outBuf.String())
+	}
+
+	jj := j.toJSON(fieldsMapFromString("dir,env"))
+	if jj.Dir != "/" {
+		t.Errorf("unexpected dir %q", jj.Dir)
+	}
+
+	if len(jj.Env) != 1 || jj.Env[0] != "FOO" {
+		t.Errorf("expected only FOO in env, got %v", jj.Env)
+	}
+}
+
+func TestJobRequestFromHeaders(t *testing.T) {
+	req, err := http.NewRequest("POST", "/jobs?env=FOO=query",
+		strings.NewReader("echo $FOO $BAR $INHERITED"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Rtot-Env", "BAR=header")
+
+	jr, err := newJobRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &serverContext{env: []string{"INHERITED=yes"}}
+	j, err := jr.newJob(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j.Run()
+	if j.outBuf.String() != "query header yes\n" {
+		t.Errorf("unexpected output %q", j.outBuf.String())
+	}
+
+	wd, _ := os.Getwd()
+	if j.dir != wd {
+		t.Errorf("expected dir to default to %q, got %q", wd, j.dir)
+	}
+}
+
+func TestJobRequestRejectsMissingDir(t *testing.T) {
+	jr := newTestJobRequest(t, "application/json", "/jobs",
+		`{"script": "pwd", "dir": "/no/such/dir"}`)
+
+	_, err := jr.newJob(&serverContext{})
+	if _, ok := err.(*jobRequestError); !ok {
+		t.Errorf("expected jobRequestError, got %v", err)
+	}
+}
+
+func TestJobRequestRejectsDisallowedUser(t *testing.T) {
+	jr := newTestJobRequest(t, "application/json", "/jobs",
+		`{"script": "id", "user": "root"}`)
+
+	_, err := jr.newJob(&serverContext{allowedUsers: "nobody"})
+	if _, ok := err.(*jobForbiddenError); !ok {
+		t.Errorf("expected jobForbiddenError, got %v", err)
+	}
+}
+
+func TestJobRequestKeepsUserGroups(t *testing.T) {
+	jr := newTestJobRequest(t, "application/json", "/jobs",
+		`{"script": "id", "user": "root"}`)
+
+	cred, err := jr.credential(&serverContext{allowedUsers: "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cred.Uid != 0 || cred.Gid != 0 || len(cred.Groups) == 0 || cred.Groups[0] != 0 {
+		t.Errorf("unexpected credential %+v", cred)
+	}
+}
+
+func TestJobRequestRejectsOutputMaxOverServerMax(t *testing.T) {
+	jr := newTestJobRequest(t, "text/plain", "/jobs?output_max=2048", "yes")
+
+	_, err := jr.newJob(&serverContext{outputLimits: outputLimits{max: 1024}})
+	if _, ok := err.(*jobForbiddenError); !ok {
+		t.Errorf("expected jobForbiddenError, got %v", err)
+	}
+}
+
+func TestJobRequestRunsAsAllowedUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root may run jobs as other users")
+	}
+
+	jr := newTestJobRequest(t, "application/json", "/jobs",
+		`{"script": "id -un", "user": "nobody", "dir": "/"}`)
+
+	j, err := jr.newJob(&serverContext{allowedUsers: "deploy, nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j.Run()
+	if j.outBuf.String() != "nobody\n" {
+		t.Errorf("unexpected output %q %q", j.outBuf.String(), j.errBuf.String())
+	}
+}
+
+func TestJobRequestFromMultipart(t *testing.T) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("request", `{"dir": "/", "env": {"GREETING": "hello"}}`)
+	mw.WriteField("script", `echo $GREETING ; cat`)
+	mw.WriteField("stdin", "from stdin\n")
+	mw.Close()
+
+	jr := newTestJobRequest(t, mw.FormDataContentType(), "/jobs", body.String())
+	if jr.Dir != "/" || jr.Stdin != "from stdin\n" || jr.Env["GREETING"] != "hello" {
+		t.Errorf("unexpected job request %+v", jr)
+	}
+
+	j, err := jr.newJob(&serverContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j.Run()
+	if j.outBuf.String() != "hello\nfrom stdin\n" {
+		t.Errorf("unexpected output %q %q", j.outBuf.String(), j.errBuf.String())
+	}
+}
+
+func TestJobRequestReadsDependencies(t *testing.T) {
+	jr := newTestJobRequest(t, "text/plain", "/jobs?after=1,2:failure", "echo after")
+	if len(jr.After) != 2 || jr.After[0].ID != 1 || jr.After[1].On != "failure" {
+		t.Errorf("unexpected dependencies %+v", jr.After)
+	}
+
+	jr = newTestJobRequest(t, "application/json", "/jobs",
+		`{"script": "echo after", "after": [3, {"id": 4, "on": "always"}]}`)
+	if len(jr.After) != 2 || jr.After[0].ID != 3 || jr.After[1].On != "always" {
+		t.Errorf("unexpected dependencies %+v", jr.After)
+	}
+
+	jr = newTestJobRequest(t, "text/plain", "/jobs?after=1:sometimes", "echo never")
+	if _, err := jr.newJob(&serverContext{}); err == nil {
+		t.Errorf("expected an unknown condition to be rejected")
+	}
+}
+
+func TestJobRequestReadsRetryPolicy(t *testing.T) {
+	jr := newTestJobRequest(t, "application/json", "/jobs",
+		`{"script": "exit 75", "retry": {"max_attempts": 3, "backoff": "2s", "exit_codes": [75]}}`)
+	j, err := jr.newJob(&serverContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Cleanup()
+
+	if j.retry == nil || j.retry.maxAttempts != 3 || j.retry.backoff != 2*time.Second || !j.retry.exitCodes[75] {
+		t.Errorf("unexpected retry policy %+v", j.retry)
+	}
+
+	jr = newTestJobRequest(t, "text/plain", "/jobs?retry=4", "exit 1")
+	if jr.Retry == nil || jr.Retry.MaxAttempts != 4 {
+		t.Errorf("unexpected retry policy %+v", jr.Retry)
+	}
+
+	jr = newTestJobRequest(t, "text/plain", "/jobs?retry=2&stdin_open=true", "cat")
+	if _, err := jr.newJob(&serverContext{}); err == nil {
+		t.Errorf("expected retrying with open stdin to be rejected")
+	}
+}
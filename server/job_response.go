@@ -1,13 +1,22 @@
 package server
 
-type jobResponse struct {
-	Jobs []*jobJSON `json:"jobs"`
+// JobResponse is the body of every response about jobs, shared with the
+// client package
+type JobResponse struct {
+	Jobs  []*JobJSON `json:"jobs"`
+	Batch int        `json:"batch,omitempty"`
 }
 
-func newJobResponse(jobs []*job, fields *map[string]int) *jobResponse {
-	mapped := []*jobJSON{}
+func newJobResponse(jobs []*job, fields *map[string]int) *JobResponse {
+	return newRangedJobResponse(jobs, fields, 0, -1)
+}
+
+// newRangedJobResponse only includes part of each job's output, as for
+// job.toRangedJSON
+func newRangedJobResponse(jobs []*job, fields *map[string]int, offset, limit int64) *JobResponse {
+	mapped := []*JobJSON{}
 	for _, j := range jobs {
-		mapped = append(mapped, j.toJSON(fields))
+		mapped = append(mapped, j.toRangedJSON(fields, offset, limit))
 	}
-	return &jobResponse{Jobs: mapped}
+	return &JobResponse{Jobs: mapped}
 }
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxRetryAttempts is the most attempts a retry policy may ask for
+	maxRetryAttempts = 100
+	// defaultMaxBackoff is the longest wait between attempts when a
+	// retry policy doesn't say
+	defaultMaxBackoff = time.Hour
+)
+
+// RetryPolicy is how a job asks to be run again when it fails: up to
+// MaxAttempts times in all, waiting Backoff before the first retry and
+// twice as long before each one after that, up to MaxBackoff.  Only the
+// given exit codes are retried, or any failure when there are none.
+type RetryPolicy struct {
+	MaxAttempts int    `json:"max_attempts"`
+	Backoff     string `json:"backoff,omitempty"`
+	MaxBackoff  string `json:"max_backoff,omitempty"`
+	ExitCodes   []int  `json:"exit_codes,omitempty"`
+}
+
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	exitCodes   map[int]bool
+}
+
+// jobAttempt is one run of a job with a retry policy.  Its output is the
+// part of the job's output between the start and end offsets.
+type jobAttempt struct {
+	Start    time.Time   `json:"start"`
+	Complete time.Time   `json:"complete"`
+	State    string      `json:"state"`
+	Exit     string      `json:"exit,omitempty"`
+	Status   *exitStatus `json:"status,omitempty"`
+	OutStart int64       `json:"out_start"`
+	OutEnd   int64       `json:"out_end"`
+	ErrStart int64       `json:"err_start"`
+	ErrEnd   int64       `json:"err_end"`
+}
+
+// AttemptJSON is how each of a job's attempts is described to clients
+type AttemptJSON struct {
+	Attempt  int    `json:"attempt"`
+	State    string `json:"state"`
+	Start    string `json:"start,omitempty"`
+	Complete string `json:"complete,omitempty"`
+	Exit     string `json:"exit,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	Out      string `json:"out,omitempty"`
+	Err      string `json:"err,omitempty"`
+}
+
+func (p *RetryPolicy) parse() (*retryPolicy, error) {
+	if p.MaxAttempts < 1 || p.MaxAttempts > maxRetryAttempts {
+		return nil, &jobRequestError{"retry.max_attempts", strconv.Itoa(p.MaxAttempts)}
+	}
+
+	rp := &retryPolicy{
+		maxAttempts: p.MaxAttempts,
+		backoff:     time.Second,
+		maxBackoff:  defaultMaxBackoff,
+	}
+	if p.Backoff != "" {
+		backoff, err := time.ParseDuration(p.Backoff)
+		if err != nil || backoff < 0 {
+			return nil, &jobRequestError{"retry.backoff", p.Backoff}
+		}
+		rp.backoff = backoff
+	}
+
+	if p.MaxBackoff != "" {
+		maxBackoff, err := time.ParseDuration(p.MaxBackoff)
+		if err != nil || maxBackoff <= 0 {
+			return nil, &jobRequestError{"retry.max_backoff", p.MaxBackoff}
+		}
+		rp.maxBackoff = maxBackoff
+	}
+
+	if len(p.ExitCodes) > 0 {
+		rp.exitCodes = map[int]bool{}
+		for _, code := range p.ExitCodes {
+			rp.exitCodes[code] = true
+		}
+	}
+	return rp, nil
+}
+
+// backoffFor is how long to wait after the given attempt, counting from
+// 1, stopping at maxBackoff before doubling could overflow
+func (rp *retryPolicy) backoffFor(attempt int) time.Duration {
+	backoff := rp.backoff
+	for i := 1; i < attempt && backoff < rp.maxBackoff; i++ {
+		if backoff > rp.maxBackoff/2 {
+			backoff = rp.maxBackoff
+			break
+		}
+		backoff *= 2
+	}
+	if backoff > rp.maxBackoff {
+		backoff = rp.maxBackoff
+	}
+	return backoff
+}
+
+// beginAttempt must be called with the state lock held
+func (j *job) beginAttempt() {
+	if j.retry == nil {
+		return
+	}
+	j.attempts = append(j.attempts, &jobAttempt{
+		Start:    time.Now().UTC(),
+		OutStart: int64(j.outBuf.Len()),
+		ErrStart: int64(j.errBuf.Len()),
+	})
+}
+
+// endAttempt must be called with the state lock held
+func (j *job) endAttempt(state string) {
+	if j.retry == nil || len(j.attempts) == 0 {
+		return
+	}
+	if state == "complete" && (j.status == nil || !j.status.Success) {
+		state = "failed"
+	}
+
+	a := j.attempts[len(j.attempts)-1]
+	a.Complete = time.Now().UTC()
+	a.State = state
+	a.Exit = exitString(j.exit)
+	a.Status = j.status
+	a.OutEnd = int64(j.outBuf.Len())
+	a.ErrEnd = int64(j.errBuf.Len())
+}
+
+// retryAfter is how long to wait before trying the job again, and
+// whether to at all.  It must be called with the state lock held.
+func (j *job) retryAfter(state string) (time.Duration, bool) {
+	rp := j.retry
+	attempt := len(j.attempts)
+	if rp == nil || attempt >= rp.maxAttempts || j.killSignal != "" || state == "killed" {
+		return 0, false
+	}
+
+	if state == "complete" && j.status != nil && j.status.Success {
+		return 0, false
+	}
+
+	if rp.exitCodes != nil && (j.status == nil || !rp.exitCodes[j.status.Code]) {
+		return 0, false
+	}
+
+	return rp.backoffFor(attempt), true
+}
+
+// nextAttempt waits out the backoff and starts the job's command again,
+// unless the job was signalled in the meantime, in which case it was
+// killed and doesn't run again.  A job running in g's queue gives up its
+// place while it waits, and queues for one again once the wait is over.
+func (j *job) nextAttempt(backoff time.Duration, g *jobGroup) (bool, error) {
+	j.stateLock.Lock()
+	wake := j.retryWake
+	j.stateLock.Unlock()
+
+	if g != nil {
+		g.pauseRetry()
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-wake:
+	}
+
+	if g != nil && !g.resumeRetry(j) {
+		return false, nil
+	}
+
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	j.retryWake = nil
+	if j.killSignal != "" {
+		j.state = "killed"
+		return false, nil
+	}
+
+	j.resetCmd()
+	j.state = "running"
+	j.beginAttempt()
+	return true, j.cmd.Start()
+}
+
+// resetCmd replaces the job's finished command with a fresh one like it
+// for the next attempt.  A fixed stdin is rewound for it, which is why
+// jobs with an open stdin, whose input is gone once read, can't retry.
+// It must be called with the state lock held.
+func (j *job) resetCmd() {
+	old := j.cmd
+	cmd := exec.Command(old.Path)
+	cmd.Args = old.Args
+	cmd.Dir = old.Dir
+	cmd.Env = old.Env
+	cmd.Stdout = old.Stdout
+	cmd.Stderr = old.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    old.SysProcAttr.Setpgid,
+		Credential: old.SysProcAttr.Credential,
+	}
+	if stdin, ok := old.Stdin.(io.ReadSeeker); ok {
+		stdin.Seek(0, io.SeekStart)
+		cmd.Stdin = stdin
+	}
+
+	if old.Process != nil {
+		old.Process.Release()
+	}
+	j.cmd = cmd
+}
+
+// attemptsJSON describes each attempt, with its own part of the output
+// when that's asked for
+func (j *job) attemptsJSON(fieldsMap map[string]int) []*AttemptJSON {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	attempts := []*AttemptJSON{}
+	for i, a := range j.attempts {
+		aj := &AttemptJSON{
+			Attempt: i + 1,
+			State:   a.State,
+			Start:   a.Start.String(),
+			Exit:    a.Exit,
+		}
+		if a.State == "" {
+			aj.State = "running"
+		} else {
+			aj.Complete = a.Complete.String()
+		}
+
+		if a.Status != nil {
+			aj.ExitCode = a.Status.exitCode()
+			aj.Signal = a.Status.Signal
+		}
+
+		outEnd, errEnd := a.OutEnd, a.ErrEnd
+		if a.State == "" {
+			outEnd, errEnd = int64(j.outBuf.Len()), int64(j.errBuf.Len())
+		}
+		if _, ok := fieldsMap["out"]; ok {
+			aj.Out = string(j.outBuf.Range(a.OutStart, outEnd-a.OutStart))
+		}
+		if _, ok := fieldsMap["err"]; ok {
+			aj.Err = string(j.errBuf.Range(a.ErrStart, errEnd-a.ErrStart))
+		}
+		attempts = append(attempts, aj)
+	}
+	return attempts
+}
+
+// savedAttempts is a copy of the job's attempts so far, for its store
+func (j *job) savedAttempts() []*jobAttempt {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+
+	attempts := []*jobAttempt{}
+	for _, a := range j.attempts {
+		saved := *a
+		attempts = append(attempts, &saved)
+	}
+	return attempts
+}
+
+// policy is the request that would give this policy, for saving it
+func (rp *retryPolicy) policy() *RetryPolicy {
+	p := &RetryPolicy{
+		MaxAttempts: rp.maxAttempts,
+		Backoff:     rp.backoff.String(),
+	}
+	if rp.maxBackoff > 0 {
+		p.MaxBackoff = rp.maxBackoff.String()
+	}
+	for code := range rp.exitCodes {
+		p.ExitCodes = append(p.ExitCodes, code)
+	}
+	sort.Ints(p.ExitCodes)
+	return p
+}
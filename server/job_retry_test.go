@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestJobRetriesUntilSuccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtot-retry-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	counter := filepath.Join(dir, "attempts")
+	j := newTestJob(t, `n=$(( $(cat `+counter+` 2>/dev/null || echo 0) + 1 ))
+echo $n > `+counter+`
+echo attempt $n
+[ $n -ge 3 ]`, &testJobOptions{retry: &RetryPolicy{MaxAttempts: 5, Backoff: "10ms"}})
+	defer j.Cleanup()
+
+	j.Run()
+	if j.state != "complete" {
+		t.Fatalf("expected state complete, got %v", j.state)
+	}
+
+	jj := j.toJSON(fieldsMapFromString("out"))
+	if len(jj.Attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %v", len(jj.Attempts))
+	}
+
+	for i, expected := range []string{"failed", "failed", "complete"} {
+		a := jj.Attempts[i]
+		if a.State != expected || a.Attempt != i+1 {
+			t.Errorf("expected attempt %v %v, got %v %v", i+1, expected, a.Attempt, a.State)
+		}
+		if out := strings.TrimSpace(a.Out); out != fmt.Sprintf("attempt %v", i+1) {
+			t.Errorf("unexpected output for attempt %v: %q", i+1, out)
+		}
+	}
+
+	if jj.Attempts[0].ExitCode == nil || *jj.Attempts[0].ExitCode != 1 {
+		t.Errorf("expected first attempt to exit 1, got %v", jj.Attempts[0].ExitCode)
+	}
+}
+
+func TestJobFailsAfterMaxAttempts(t *testing.T) {
+	j := newTestJob(t, "exit 1",
+		&testJobOptions{retry: &RetryPolicy{MaxAttempts: 2, Backoff: "10ms"}})
+	defer j.Cleanup()
+
+	j.Run()
+	if j.state != "failed" || len(j.attempts) != 2 {
+		t.Errorf("expected failed after 2 attempts, got %v after %v", j.state, len(j.attempts))
+	}
+}
+
+func TestJobOnlyRetriesGivenExitCodes(t *testing.T) {
+	j := newTestJob(t, "exit 3", &testJobOptions{
+		retry: &RetryPolicy{MaxAttempts: 3, Backoff: "10ms", ExitCodes: []int{75}},
+	})
+	defer j.Cleanup()
+
+	j.Run()
+	if j.state != "failed" || len(j.attempts) != 1 {
+		t.Errorf("expected failed after 1 attempt, got %v after %v", j.state, len(j.attempts))
+	}
+}
+
+func TestJobRetryRefeedsStdin(t *testing.T) {
+	j := newTestJob(t, "cat ; exit 1",
+		&testJobOptions{retry: &RetryPolicy{MaxAttempts: 2, Backoff: "10ms"}})
+	defer j.Cleanup()
+	j.cmd.Stdin = strings.NewReader("hi\n")
+
+	j.Run()
+	if out := j.outBuf.String(); out != "hi\nhi\n" {
+		t.Errorf("expected stdin on each attempt, got %q", out)
+	}
+}
+
+func TestJobSignalStopsRetrying(t *testing.T) {
+	j := newTestJob(t, "exit 1",
+		&testJobOptions{retry: &RetryPolicy{MaxAttempts: 3, Backoff: "10s"}})
+	defer j.Cleanup()
+
+	go j.Run()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		j.stateLock.Lock()
+		state := j.state
+		j.stateLock.Unlock()
+		if state == "retrying" {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("job never started retrying, state %v", state)
+		}
+	}
+
+	if _, err := j.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-j.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("job kept waiting to retry")
+	}
+
+	if j.state != "killed" || len(j.attempts) != 1 {
+		t.Errorf("expected killed after 1 attempt, got %v after %v", j.state, len(j.attempts))
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	rp, err := (&RetryPolicy{MaxAttempts: 5, Backoff: "1s", MaxBackoff: "3s"}).parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if backoff := rp.backoffFor(attempt + 1); backoff != expected {
+			t.Errorf("expected backoff %v after attempt %v, got %v", expected, attempt+1, backoff)
+		}
+	}
+}
+
+func TestRetryPolicyCapsBackoffByDefault(t *testing.T) {
+	for _, backoff := range []string{"1s", "1000000h"} {
+		rp, err := (&RetryPolicy{MaxAttempts: maxRetryAttempts, Backoff: backoff}).parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := rp.backoffFor(maxRetryAttempts); got != defaultMaxBackoff {
+			t.Errorf("expected backoff from %v capped at %v, got %v", backoff, defaultMaxBackoff, got)
+		}
+	}
+}
+
+func TestJobKeepsTimedOutAfterLastAttempt(t *testing.T) {
+	j := newTestJob(t, "sleep 5",
+		&testJobOptions{retry: &RetryPolicy{MaxAttempts: 2, Backoff: "10ms"}})
+	defer j.Cleanup()
+	j.timeout = 50 * time.Millisecond
+
+	j.Run()
+	if j.state != "timed_out" || len(j.attempts) != 2 || j.attempts[1].State != "timed_out" {
+		t.Errorf("expected timed_out after 2 attempts, got %v after %v", j.state, len(j.attempts))
+	}
+}
+
+func TestJobGroupFreesPlaceWhileRetrying(t *testing.T) {
+	g, err := NewJobGroup("retry-place", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+	g.SetLimits(1, 0)
+
+	retrying, err := submitTestJob(t, g, "exit 1",
+		&testJobOptions{retry: &RetryPolicy{MaxAttempts: 2, Backoff: "500ms"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := submitTestJob(t, g, "echo queued", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForTestJob(t, queued)
+	if retrying.isDone() {
+		t.Errorf("expected the queued job to run while the other waited to retry")
+	}
+
+	waitForTestJob(t, retrying)
+	if retrying.currentState() != "failed" || len(retrying.savedAttempts()) != 2 {
+		t.Errorf("expected failed after 2 attempts, got %v", retrying.currentState())
+	}
+
+	g.queue.Lock()
+	defer g.queue.Unlock()
+	if g.queue.running != 0 {
+		t.Errorf("expected no jobs left running, got %v", g.queue.running)
+	}
+}
+
+func TestJobGroupSignalCancelsQueuedRetries(t *testing.T) {
+	g, err := NewJobGroup("retry-cancel", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+	g.SetLimits(1, 0)
+
+	sub := g.events.Subscribe(&eventFilter{states: map[string]bool{"queued": true}})
+	defer g.events.Unsubscribe(sub)
+
+	retrying, err := submitTestJob(t, g, "exit 1",
+		&testJobOptions{retry: &RetryPolicy{MaxAttempts: 3, Backoff: "10ms"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, err := submitTestJob(t, g, "sleep 0.5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCompletions(t, sub, 2)
+
+	if err := g.Signal(retrying.id, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitForTestJob(t, retrying)
+	if retrying.currentState() != "killed" || len(retrying.savedAttempts()) != 1 {
+		t.Errorf("expected killed after 1 attempt, got %v", retrying.currentState())
+	}
+
+	waitForTestJob(t, busy)
+	time.Sleep(50 * time.Millisecond)
+
+	g.queue.Lock()
+	defer g.queue.Unlock()
+	if g.queue.running != 0 || len(g.queue.waiting) != 0 {
+		t.Errorf("expected an empty queue, got %v running and %v waiting",
+			g.queue.running, len(g.queue.waiting))
+	}
+}
+
+func TestRetryPolicyRejectsInvalidValues(t *testing.T) {
+	for _, p := range []*RetryPolicy{
+		{MaxAttempts: 0},
+		{MaxAttempts: maxRetryAttempts + 1},
+		{MaxAttempts: 2, Backoff: "soon"},
+		{MaxAttempts: 2, MaxBackoff: "-1s"},
+	} {
+		if _, err := p.parse(); err == nil {
+			t.Errorf("expected %+v to be rejected", p)
+		}
+	}
+}
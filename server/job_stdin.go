@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+var errStdinClosed = fmt.Errorf("stdin is closed")
+
+// jobStdin is the write end of a job's stdin pipe, which stays open for
+// input posted while the job runs until it's closed or the job exits.
+// Writes hold writing rather than the jobStdin's own lock, so a child
+// that never reads its stdin can't hold up Close, which unblocks them.
+type jobStdin struct {
+	sync.Mutex
+	writing sync.Mutex
+	w       io.WriteCloser
+	pending []byte
+	closed  bool
+}
+
+// openStdin gives the job a stdin pipe, with data to be written to it
+// first once the job starts
+func (j *job) openStdin(data []byte) error {
+	w, err := j.cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	j.stdin = &jobStdin{w: w, pending: data}
+	return nil
+}
+
+// writePending must only be called once the job has started, so that
+// writes to a full pipe don't hold anything up before then
+func (s *jobStdin) writePending() {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+
+	s.flushPending()
+}
+
+// flushPending must be called with writing held
+func (s *jobStdin) flushPending() error {
+	s.Lock()
+	pending, closed := s.pending, s.closed
+	s.pending = nil
+	s.Unlock()
+
+	if len(pending) == 0 || closed {
+		return nil
+	}
+	_, err := s.write(pending)
+	return err
+}
+
+// write must be called with writing held
+func (s *jobStdin) write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil && s.state() == "closed" {
+		err = errStdinClosed
+	}
+	return n, err
+}
+
+// Write sends any pending data first, so that it always comes before
+// whatever is posted once the job starts
+func (s *jobStdin) Write(p []byte) (int, error) {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+
+	if s.state() == "closed" {
+		return 0, errStdinClosed
+	}
+	if err := s.flushPending(); err != nil {
+		return 0, err
+	}
+	return s.write(p)
+}
+
+// CloseWhenWritten closes stdin once any pending data has been sent,
+// for closing it on purpose rather than because the job is gone
+func (s *jobStdin) CloseWhenWritten() error {
+	s.writing.Lock()
+	s.flushPending()
+	s.writing.Unlock()
+
+	return s.Close()
+}
+
+// Close doesn't wait for writes, which fail once the pipe is closed
+func (s *jobStdin) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.w.Close()
+}
+
+func (s *jobStdin) state() string {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return "closed"
+	}
+	return "open"
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestJobStdinCloseUnblocksWrites(t *testing.T) {
+	j, err := newJob("sleep 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Cleanup()
+	if err := j.openStdin(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	go j.Run()
+	defer j.Signal(syscall.SIGKILL)
+	for !j.hasStarted() {
+		time.Sleep(time.Millisecond)
+	}
+
+	written := make(chan error)
+	go func() {
+		_, err := j.stdin.Write(make([]byte, 1<<20))
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		t.Fatalf("expected the write to a full pipe to block, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		j.stdin.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close waited for the blocked write")
+	}
+
+	select {
+	case err := <-written:
+		if err != errStdinClosed {
+			t.Errorf("expected errStdinClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocked write never returned")
+	}
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"os"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestNewJob(t *testing.T) {
@@ -43,3 +45,159 @@ func TestJobCleanupRemovesJobFile(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestJobRunTimesOut(t *testing.T) {
+	j, err := newJob("sleep 10")
+	if err != nil {
+		t.Error(err)
+	}
+
+	j.timeout = 50 * time.Millisecond
+	j.grace = time.Second
+	j.Run()
+
+	if j.state != "timed_out" {
+		t.Errorf("expected state timed_out, got %q", j.state)
+	}
+
+	if j.snapshot().elapsed() >= time.Second {
+		t.Errorf("expected SIGTERM to end the job, took %v", j.snapshot().elapsed())
+	}
+}
+
+func TestJobRunKillsAfterGracePeriod(t *testing.T) {
+	j, err := newJob("trap '' TERM ; sleep 10 & wait ; sleep 10")
+	if err != nil {
+		t.Error(err)
+	}
+
+	j.timeout = 50 * time.Millisecond
+	j.grace = 50 * time.Millisecond
+	j.Run()
+
+	if j.state != "timed_out" {
+		t.Errorf("expected state timed_out, got %q", j.state)
+	}
+
+	if j.snapshot().elapsed() >= 5*time.Second {
+		t.Errorf("expected SIGKILL to end the job, took %v", j.snapshot().elapsed())
+	}
+}
+
+func TestJobRunRecordsExitCode(t *testing.T) {
+	j, err := newJob("exit 3")
+	if err != nil {
+		t.Error(err)
+	}
+
+	j.Run()
+	jj := j.toJSON(fieldsMapFromString("exit_code,success,signal"))
+	if jj.ExitCode == nil || *jj.ExitCode != 3 {
+		t.Errorf("expected exit_code 3, got %v", jj.ExitCode)
+	}
+
+	if jj.Success == nil || *jj.Success {
+		t.Errorf("expected success false, got %v", jj.Success)
+	}
+
+	if jj.Signal != "" {
+		t.Errorf("expected no signal, got %q", jj.Signal)
+	}
+
+	if jj.Exit != "exit status 3" {
+		t.Errorf("expected exit to be kept, got %q", jj.Exit)
+	}
+}
+
+func TestJobRunRecordsSignal(t *testing.T) {
+	j, err := newJob("kill -USR1 $$")
+	if err != nil {
+		t.Error(err)
+	}
+
+	j.Run()
+	jj := j.toJSON(fieldsMapFromString("exit_code,signal"))
+	if jj.ExitCode != nil {
+		t.Errorf("expected no exit_code, got %v", *jj.ExitCode)
+	}
+
+	if jj.Signal != "SIGUSR1" {
+		t.Errorf("expected signal SIGUSR1, got %q", jj.Signal)
+	}
+}
+
+func TestJobGroupSignalKillsProcessGroup(t *testing.T) {
+	g, err := NewJobGroup("signal-running", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := g.events.Subscribe(&eventFilter{states: map[string]bool{"running": true}})
+	defer g.events.Unsubscribe(sub)
+
+	// the backgrounded sleep holds on to stdout, so the job only finishes
+	// early if the whole process group is signalled
+	j, err := newJob("sleep 5 & wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Add(j)
+	go j.Run()
+	waitForCompletions(t, sub, 1)
+
+	if err := g.Signal(j.id, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-j.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("job survived SIGTERM")
+	}
+
+	if j.state != "killed" || j.signalled() != "SIGTERM" || j.status.Signal != "SIGTERM" {
+		t.Errorf("unexpected state %v, signal %v, status %+v", j.state, j.signalled(), j.status)
+	}
+
+	if err := g.Signal(j.id, syscall.SIGTERM); err != errJobDone {
+		t.Errorf("expected errJobDone, got %v", err)
+	}
+}
+
+func TestJobGroupStopKillsAfterGracePeriod(t *testing.T) {
+	g, err := NewJobGroup("signal-stop", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+
+	j, err := newJob("trap '' TERM ; echo trapped ; sleep 5 & wait ; sleep 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.grace = 50 * time.Millisecond
+	g.Add(j)
+	go j.Run()
+
+	// TERM has to arrive after the trap for KILL to be needed
+	for start := time.Now(); j.outBuf.String() == ""; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("job never set its trap")
+		}
+	}
+
+	if err := g.Stop(j.id); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-j.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("job survived the grace period")
+	}
+
+	snap := j.snapshot()
+	if snap.state != "killed" || j.signalled() != "SIGKILL" || snap.status.Signal != "SIGKILL" {
+		t.Errorf("unexpected state %v, signal %v, status %+v", snap.state, j.signalled(), snap.status)
+	}
+}
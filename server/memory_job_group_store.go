@@ -41,7 +41,7 @@ func (m *memoryJobGroupStore) Getall(state string) []*job {
 
 	ret := []*job{}
 	for _, job := range m.group {
-		if state == "" || job.state == state {
+		if state == "" || job.currentState() == state {
 			ret = append(ret, job)
 		}
 	}
@@ -61,3 +61,25 @@ func (m *memoryJobGroupStore) Remove(i int) bool {
 	delete(m.group, i)
 	return true
 }
+
+func (m *memoryJobGroupStore) Save(j *job) error {
+	return nil
+}
+
+func (m *memoryJobGroupStore) Cur() int {
+	return 0
+}
+
+// SaveSchedules does nothing, as schedules are already in memory
+func (m *memoryJobGroupStore) SaveSchedules(schedules []*schedule) error {
+	return nil
+}
+
+func (m *memoryJobGroupStore) LoadSchedules() ([]*schedule, error) {
+	return nil, nil
+}
+
+// Destroy does nothing, as the jobs go with the group
+func (m *memoryJobGroupStore) Destroy() error {
+	return nil
+}
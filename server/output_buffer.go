@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// sinceChunk is the most Since returns at once, so that following a job
+// with a lot of spooled output doesn't read it all into memory
+const sinceChunk = 1 << 20
+
+// outputLimits bound how much of a job's output is kept.  Output beyond
+// memory bytes is spooled to a file in spoolDir, and output beyond max
+// bytes is dropped.  A zero limit means no limit.
+type outputLimits struct {
+	memory   int64
+	max      int64
+	spoolDir string
+}
+
+// outputBuffer collects a job's output and lets readers wait for more of
+// it to arrive until the buffer is closed.  Output saved by a store is
+// read back from its saved file as it's needed instead.
+type outputBuffer struct {
+	sync.Mutex
+	buf     bytes.Buffer
+	spool   *os.File
+	saved   string
+	limits  outputLimits
+	size    int64
+	written int64
+	closed  bool
+	changed chan struct{}
+}
+
+func newOutputBuffer() *outputBuffer {
+	return &outputBuffer{changed: make(chan struct{})}
+}
+
+// newSavedOutputBuffer is the output saved to filename, of which there
+// were written bytes in all
+func newSavedOutputBuffer(filename string, written int64) (*outputBuffer, error) {
+	o := newOutputBuffer()
+	o.closed = true
+
+	fi, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		o.written = written
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	o.saved = filename
+	o.size = fi.Size()
+	o.written = written
+	if o.written < o.size {
+		o.written = o.size
+	}
+	return o, nil
+}
+
+// setLimits must be called before anything is written, or on saved
+// output to keep no more of it than limits allow
+func (o *outputBuffer) setLimits(limits outputLimits) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.limits = limits
+	if o.saved != "" && limits.max > 0 && o.size > limits.max {
+		o.size = limits.max
+	}
+}
+
+// Write always claims to have written everything, even what it drops,
+// so that jobs don't get EPIPE for producing too much output
+func (o *outputBuffer) Write(p []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	n := len(p)
+	o.written += int64(n)
+
+	if o.limits.max > 0 && o.size+int64(len(p)) > o.limits.max {
+		p = p[:o.limits.max-o.size]
+	}
+
+	if o.limits.memory <= 0 || o.spool == nil && o.size+int64(len(p)) <= o.limits.memory {
+		o.buf.Write(p)
+		o.size += int64(len(p))
+		o.broadcast()
+		return n, nil
+	}
+
+	if o.spool == nil {
+		inMemory := o.limits.memory - o.size
+		o.buf.Write(p[:inMemory])
+		o.size += inMemory
+		p = p[inMemory:]
+
+		spool, err := ioutil.TempFile(o.limits.spoolDir, "rtot-output-")
+		if err != nil {
+			o.broadcast()
+			return n, nil
+		}
+		o.spool = spool
+	}
+
+	written, _ := o.spool.Write(p)
+	o.size += int64(written)
+	o.broadcast()
+	return n, nil
+}
+
+// Close marks the end of output and wakes up any waiting readers
+func (o *outputBuffer) Close() error {
+	o.Lock()
+	defer o.Unlock()
+
+	if !o.closed {
+		o.closed = true
+		o.broadcast()
+	}
+	return nil
+}
+
+// Remove closes the buffer and deletes its spool file, if any
+func (o *outputBuffer) Remove() error {
+	o.Close()
+
+	o.Lock()
+	defer o.Unlock()
+
+	if o.spool == nil {
+		return nil
+	}
+	o.spool.Close()
+	err := os.Remove(o.spool.Name())
+	o.spool = nil
+	return err
+}
+
+// WriteTo copies the kept output to w, streaming what was spooled or
+// saved rather than reading it all into memory
+func (o *outputBuffer) WriteTo(w io.Writer) (int64, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	n, err := w.Write(o.buf.Bytes())
+	if err != nil {
+		return int64(n), err
+	}
+
+	rest := o.size - int64(o.buf.Len())
+	if rest <= 0 {
+		return int64(n), nil
+	}
+
+	f := o.spool
+	if f == nil {
+		f, err = os.Open(o.saved)
+		if err != nil {
+			return int64(n), err
+		}
+		defer f.Close()
+	}
+	copied, err := io.Copy(w, io.NewSectionReader(f, 0, rest))
+	return int64(n) + copied, err
+}
+
+func (o *outputBuffer) Bytes() []byte {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.read(0, -1)
+}
+
+func (o *outputBuffer) String() string {
+	return string(o.Bytes())
+}
+
+// Len is how many bytes of output have been kept
+func (o *outputBuffer) Len() int {
+	o.Lock()
+	defer o.Unlock()
+
+	return int(o.size)
+}
+
+// Written is how many bytes of output there were, kept or not
+func (o *outputBuffer) Written() int64 {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.written
+}
+
+// Truncated is true when some output was dropped
+func (o *outputBuffer) Truncated() bool {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.written > o.size
+}
+
+// Range returns up to limit bytes starting at offset, or everything from
+// offset on when limit is negative
+func (o *outputBuffer) Range(offset, limit int64) []byte {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.read(offset, limit)
+}
+
+// Since returns a copy of what was written after offset, up to
+// sinceChunk bytes of it, whether the buffer has been closed, and a
+// channel that is closed the next time anything is written or the
+// buffer is closed
+func (o *outputBuffer) Since(offset int) ([]byte, bool, <-chan struct{}) {
+	o.Lock()
+	defer o.Unlock()
+
+	data := o.read(int64(offset), sinceChunk)
+	closed := o.closed && int64(offset)+int64(len(data)) >= o.size
+	return data, closed, o.changed
+}
+
+// read must be called with the lock held
+func (o *outputBuffer) read(offset, limit int64) []byte {
+	if offset > o.size {
+		offset = o.size
+	}
+	end := o.size
+	if limit >= 0 && limit < end-offset {
+		end = offset + limit
+	}
+
+	data := make([]byte, 0, end-offset)
+	inMemory := int64(o.buf.Len())
+	if offset < inMemory {
+		memEnd := end
+		if memEnd > inMemory {
+			memEnd = inMemory
+		}
+		data = append(data, o.buf.Bytes()[offset:memEnd]...)
+	}
+
+	if end > inMemory && (o.spool != nil || o.saved != "") {
+		from := offset
+		if from < inMemory {
+			from = inMemory
+		}
+		chunk := make([]byte, end-from)
+		n := o.readFile(chunk, from-inMemory)
+		data = append(data, chunk[:n]...)
+	}
+
+	return data
+}
+
+// readFile reads from the spool or the saved output, and must be called
+// with the lock held
+func (o *outputBuffer) readFile(p []byte, offset int64) int {
+	if o.spool != nil {
+		n, _ := o.spool.ReadAt(p, offset)
+		return n
+	}
+
+	f, err := os.Open(o.saved)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	n, _ := f.ReadAt(p, offset)
+	return n
+}
+
+// broadcast must be called with the lock held
+func (o *outputBuffer) broadcast() {
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputBufferSpoolsPastMemoryLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtot-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := newOutputBuffer()
+	o.setLimits(outputLimits{memory: 4, spoolDir: dir})
+	o.Write([]byte("abc"))
+	o.Write([]byte("defgh"))
+
+	if o.buf.Len() != 4 || o.spool == nil {
+		t.Fatalf("expected 4 bytes in memory and the rest spooled")
+	}
+	if o.String() != "abcdefgh" {
+		t.Errorf("unexpected output %q", o.String())
+	}
+	if string(o.Range(2, 4)) != "cdef" {
+		t.Errorf("unexpected range %q", o.Range(2, 4))
+	}
+
+	data, _, _ := o.Since(5)
+	if string(data) != "fgh" {
+		t.Errorf("unexpected output since 5 %q", data)
+	}
+
+	o.Remove()
+	if spooled, _ := filepath.Glob(filepath.Join(dir, "*")); len(spooled) != 0 {
+		t.Errorf("expected the spool file to be removed, got %v", spooled)
+	}
+}
+
+func TestOutputBufferTruncatesPastMax(t *testing.T) {
+	o := newOutputBuffer()
+	o.setLimits(outputLimits{max: 5})
+
+	n, err := o.Write([]byte("abcdefgh"))
+	if n != 8 || err != nil {
+		t.Errorf("expected dropped output to count as written, got %v %v", n, err)
+	}
+	o.Write([]byte("ij"))
+
+	if o.String() != "abcde" {
+		t.Errorf("unexpected output %q", o.String())
+	}
+	if o.Written() != 10 || !o.Truncated() {
+		t.Errorf("expected 10 bytes written and truncation, got %v %v",
+			o.Written(), o.Truncated())
+	}
+}
+
+func TestOutputBufferRangeHandlesHugeLimits(t *testing.T) {
+	o := newOutputBuffer()
+	o.Write([]byte("abcdef"))
+
+	for offset, expected := range map[int64]string{0: "abcdef", 1: "bcdef", 6: "", 7: ""} {
+		if data := o.Range(offset, math.MaxInt64); string(data) != expected {
+			t.Errorf("expected %q from offset %v, got %q", expected, offset, data)
+		}
+	}
+	if data := o.Range(1, math.MaxInt64-1); string(data) != "bcdef" {
+		t.Errorf("unexpected range %q", data)
+	}
+}
+
+func TestOutputBufferSavesAndReadsBackSpooledOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtot-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := newOutputBuffer()
+	o.setLimits(outputLimits{memory: 4, spoolDir: dir})
+	o.Write([]byte("abcdefgh"))
+	o.Close()
+	defer o.Remove()
+
+	filename := filepath.Join(dir, "out")
+	if err := writeFileAtomicFrom(filename, o); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := newSavedOutputBuffer(filename, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.buf.Len() != 0 || saved.String() != "abcdefgh" {
+		t.Errorf("expected saved output to be read from its file, got %q", saved.String())
+	}
+	if string(saved.Range(3, 2)) != "de" || saved.Written() != 10 || !saved.Truncated() {
+		t.Errorf("unexpected saved buffer %q %v", saved.Range(3, 2), saved.Written())
+	}
+
+	saved.setLimits(outputLimits{max: 5})
+	if saved.String() != "abcde" {
+		t.Errorf("expected saved output to be kept to its limits, got %q", saved.String())
+	}
+}
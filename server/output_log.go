@@ -0,0 +1,262 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// logSpanSize is roughly what each span costs to keep, for counting the
+// log's own size against a job's output
+const logSpanSize = 64
+
+// LogEntry is one write to a job's stdout or stderr, as recorded in its
+// combined log
+type LogEntry struct {
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+	Data   string    `json:"data"`
+}
+
+// logSpan is a stretch of the combined log taken from one stream's
+// buffer, from offset on in that buffer and from start on in the log
+type logSpan struct {
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+	Start  int64     `json:"start"`
+	Offset int64     `json:"offset"`
+	Length int64     `json:"length"`
+}
+
+// outputLog is the combined log of a job's stdout and stderr in the order
+// their output arrived.  It doesn't hold the output itself, just spans of
+// the two streams' buffers, so it only covers output those buffers kept.
+// Consecutive writes to the same stream share a span unless the log is
+// timed, in which case each write gets its own span and the time it
+// arrived, taken from the monotonic clock so that times never go
+// backwards even if the wall clock does.  The spans are kept in memory
+// and the log stops growing once they take limit bytes.
+type outputLog struct {
+	sync.Mutex
+	out       *outputBuffer
+	err       *outputBuffer
+	spans     []*logSpan
+	ends      map[string]int64
+	timed     bool
+	base      time.Time
+	limit     int64
+	size      int64
+	truncated bool
+	closed    bool
+	changed   chan struct{}
+}
+
+func newOutputLog(out, err *outputBuffer) *outputLog {
+	return &outputLog{
+		out:     out,
+		err:     err,
+		ends:    map[string]int64{},
+		base:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// newClosedOutputLog is the log of output that has already been kept,
+// which is all of out followed by all of err when spans is nil
+func newClosedOutputLog(out, err *outputBuffer, spans []*logSpan, timed bool) *outputLog {
+	l := newOutputLog(out, err)
+	l.timed = timed
+	if spans == nil {
+		l.add("out")
+		l.add("err")
+	}
+	for _, s := range spans {
+		l.spans = append(l.spans, s)
+		l.size = s.Start + s.Length
+	}
+	l.Close()
+	return l
+}
+
+// setTimed gives each write its own entry with its own time, and must be
+// called before anything is written
+func (l *outputLog) setTimed() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.timed = true
+}
+
+// Timed is true when the log has an entry for each write
+func (l *outputLog) Timed() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.timed
+}
+
+// setLimits keeps at most as many spans as would fit in the memory kept
+// for a single stream
+func (l *outputLog) setLimits(limits outputLimits) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.limit = limits.memory
+	if limits.max > 0 && (l.limit <= 0 || limits.max < l.limit) {
+		l.limit = limits.max
+	}
+}
+
+func (l *outputLog) writer(stream string) *outputLogWriter {
+	return &outputLogWriter{l, stream}
+}
+
+func (l *outputLog) buffer(stream string) *outputBuffer {
+	if stream == "err" {
+		return l.err
+	}
+	return l.out
+}
+
+// add logs whatever the stream's buffer has kept since it was last added
+func (l *outputLog) add(stream string) {
+	l.Lock()
+	defer l.Unlock()
+
+	end := int64(l.buffer(stream).Len())
+	length := end - l.ends[stream]
+	if length <= 0 {
+		return
+	}
+
+	if n := len(l.spans); !l.timed && n > 0 && l.spans[n-1].Stream == stream {
+		l.spans[n-1].Length += length
+	} else if l.limit > 0 && int64(n+1)*logSpanSize > l.limit {
+		l.truncated = true
+		return
+	} else {
+		l.spans = append(l.spans, &logSpan{
+			Stream: stream,
+			Time:   l.base.Add(time.Since(l.base)).UTC(),
+			Start:  l.size,
+			Offset: l.ends[stream],
+			Length: length,
+		})
+	}
+
+	l.ends[stream] = end
+	l.size += length
+	l.broadcast()
+}
+
+// Close marks the end of the log and wakes up any waiting readers
+func (l *outputLog) Close() {
+	l.Lock()
+	defer l.Unlock()
+
+	if !l.closed {
+		l.closed = true
+		l.broadcast()
+	}
+}
+
+// Spans returns a copy of the log's spans, for saving them
+func (l *outputLog) Spans() []*logSpan {
+	l.Lock()
+	defer l.Unlock()
+
+	spans := []*logSpan{}
+	for _, s := range l.spans {
+		copied := *s
+		spans = append(spans, &copied)
+	}
+	return spans
+}
+
+// Size is roughly how many bytes the log itself takes
+func (l *outputLog) Size() int64 {
+	l.Lock()
+	defer l.Unlock()
+
+	return int64(len(l.spans)) * logSpanSize
+}
+
+// Truncated is true when some output wasn't logged
+func (l *outputLog) Truncated() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.truncated
+}
+
+// Since returns a copy of the combined output after offset, up to
+// sinceChunk bytes of it, whether the log has been closed, and a channel
+// that is closed the next time anything is logged or the log is closed
+func (l *outputLog) Since(offset int) ([]byte, bool, <-chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	data := []byte{}
+	from := int64(offset)
+	i := sort.Search(len(l.spans), func(i int) bool {
+		return l.spans[i].Start+l.spans[i].Length > from
+	})
+	for ; i < len(l.spans) && len(data) < sinceChunk; i++ {
+		s := l.spans[i]
+		skip := from - s.Start
+		limit := s.Length - skip
+		if room := int64(sinceChunk - len(data)); limit > room {
+			limit = room
+		}
+		chunk := l.buffer(s.Stream).Range(s.Offset+skip, limit)
+		data = append(data, chunk...)
+		from += int64(len(chunk))
+	}
+
+	closed := l.closed && from >= l.size
+	return data, closed, l.changed
+}
+
+func (l *outputLog) Entries() []*LogEntry {
+	entries, _, _ := l.EntriesSince(0)
+	return entries
+}
+
+// EntriesSince returns the entries after the first offset of them,
+// whether the log has been closed, and a channel that is closed the next
+// time an entry is added or the log is closed
+func (l *outputLog) EntriesSince(offset int) ([]*LogEntry, bool, <-chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	if offset > len(l.spans) {
+		offset = len(l.spans)
+	}
+	entries := []*LogEntry{}
+	for _, s := range l.spans[offset:] {
+		entries = append(entries, &LogEntry{
+			Stream: s.Stream,
+			Time:   s.Time,
+			Data:   string(l.buffer(s.Stream).Range(s.Offset, s.Length)),
+		})
+	}
+	return entries, l.closed, l.changed
+}
+
+// broadcast must be called with the lock held
+func (l *outputLog) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// outputLogWriter logs what its stream's buffer kept of everything
+// written to it, and must come after that buffer when writing to both
+type outputLogWriter struct {
+	l      *outputLog
+	stream string
+}
+
+func (w *outputLogWriter) Write(p []byte) (int, error) {
+	w.l.add(w.stream)
+	return len(p), nil
+}
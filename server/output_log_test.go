@@ -0,0 +1,81 @@
+package server
+
+import (
+	"io"
+	"testing"
+)
+
+func TestOutputLogRecordsWritesInOrder(t *testing.T) {
+	j, err := newJob("echo one ; sleep 0.1 ; echo two >&2 ; sleep 0.1 ; echo three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Cleanup()
+
+	j.recordLog()
+	j.Run()
+
+	entries := j.outLog.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", len(entries))
+	}
+
+	expected := []LogEntry{{Stream: "out", Data: "one\n"}, {Stream: "err", Data: "two\n"}, {Stream: "out", Data: "three\n"}}
+	for i, e := range entries {
+		if e.Stream != expected[i].Stream || e.Data != expected[i].Data {
+			t.Errorf("unexpected entry %v: %+v", i, e)
+		}
+		if i > 0 && e.Time.Before(entries[i-1].Time) {
+			t.Errorf("entry %v went back in time", i)
+		}
+	}
+
+	if j.outBuf.String() != "one\nthree\n" {
+		t.Errorf("unexpected output %q", j.outBuf.String())
+	}
+}
+
+func newTestOutputLog(limits outputLimits) (*outputLog, map[string]io.Writer) {
+	out, err := newOutputBuffer(), newOutputBuffer()
+	l := newOutputLog(out, err)
+	l.setLimits(limits)
+	return l, map[string]io.Writer{
+		"out": io.MultiWriter(out, l.writer("out")),
+		"err": io.MultiWriter(err, l.writer("err")),
+	}
+}
+
+func TestOutputLogInterleavesStreams(t *testing.T) {
+	l, w := newTestOutputLog(outputLimits{})
+	w["out"].Write([]byte("abc"))
+	w["out"].Write([]byte("de"))
+	w["err"].Write([]byte("fgh"))
+	w["out"].Write([]byte("ij"))
+	l.Close()
+
+	if len(l.Spans()) != 3 {
+		t.Errorf("expected writes to the same stream to share a span, got %+v", l.Spans())
+	}
+
+	data, closed, _ := l.Since(4)
+	if string(data) != "efghij" || !closed {
+		t.Errorf("unexpected log %q, closed %v", data, closed)
+	}
+}
+
+func TestOutputLogStopsAtLimit(t *testing.T) {
+	l, w := newTestOutputLog(outputLimits{memory: 2 * logSpanSize})
+	l.setTimed()
+	w["out"].Write([]byte("abc"))
+	w["err"].Write([]byte("de"))
+	w["out"].Write([]byte("fg"))
+
+	entries := l.Entries()
+	if len(entries) != 2 || entries[1].Data != "de" || !l.Truncated() {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+
+	if l.Size() != 2*logSpanSize {
+		t.Errorf("expected the log to count its spans, got %v", l.Size())
+	}
+}
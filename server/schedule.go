@@ -0,0 +1,387 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	errNoSuchSchedule  = fmt.Errorf("no such schedule")
+	errSchedulerNotRun = fmt.Errorf("schedules aren't running in this group")
+)
+
+// scheduleRequest is a job request plus when to run it, either as a cron
+// expression or at a fixed interval
+type scheduleRequest struct {
+	Cron    string `json:"cron,omitempty"`
+	Every   string `json:"every,omitempty"`
+	Overlap string `json:"overlap,omitempty"`
+	jobRequest
+}
+
+// schedule creates a job in its group each time it fires.  When the job
+// from the last firing is still going, the overlap policy decides what
+// happens: "skip" doesn't create a job this time, "queue" creates one
+// once the last one is done, and "allow" creates one anyway.
+type schedule struct {
+	id         int
+	request    *scheduleRequest
+	cron       *cronSpec
+	every      time.Duration
+	createTime time.Time
+	lastRun    time.Time
+	nextRun    time.Time
+	lastJob    int
+	runs       int
+	skipped    int
+	pending    bool
+	stop       chan struct{}
+}
+
+// scheduler holds a job group's schedules, creating their jobs with the
+// server's settings
+type scheduler struct {
+	sync.Mutex
+	c         *serverContext
+	cur       int
+	schedules map[int]*schedule
+}
+
+func newSchedule(sr *scheduleRequest) (*schedule, error) {
+	s := &schedule{
+		request:    sr,
+		createTime: time.Now().UTC(),
+		lastJob:    -1,
+	}
+
+	switch {
+	case sr.Cron != "" && sr.Every != "":
+		return nil, &jobRequestError{"every", sr.Every}
+	case sr.Cron != "":
+		spec, err := parseCron(sr.Cron)
+		if err != nil {
+			return nil, &jobRequestError{"cron", sr.Cron}
+		}
+		s.cron = spec
+	case sr.Every != "":
+		every, err := time.ParseDuration(sr.Every)
+		if err != nil || every < time.Second {
+			return nil, &jobRequestError{"every", sr.Every}
+		}
+		s.every = every
+	default:
+		return nil, &jobRequestError{"cron", ""}
+	}
+
+	switch sr.Overlap {
+	case "":
+		sr.Overlap = "skip"
+	case "skip", "queue", "allow":
+	default:
+		return nil, &jobRequestError{"overlap", sr.Overlap}
+	}
+
+	if sr.StdinOpen {
+		return nil, &jobRequestError{"stdin_open", "true"}
+	}
+	if sr.RunAt != "" {
+		return nil, &jobRequestError{"run_at", sr.RunAt}
+	}
+	if sr.Delay != "" {
+		return nil, &jobRequestError{"delay", sr.Delay}
+	}
+	if len(sr.After) > 0 {
+		return nil, &jobRequestError{"after", strconv.Itoa(sr.After[0].ID)}
+	}
+
+	return s, nil
+}
+
+// next is when the schedule fires after t, or the zero time if never
+func (s *schedule) next(t time.Time) time.Time {
+	if s.cron != nil {
+		return s.cron.next(t)
+	}
+	return t.Add(s.every)
+}
+
+// StartScheduler runs the group's schedules, including any saved by its
+// store, until the group is removed
+func (g *jobGroup) StartScheduler(c *serverContext) error {
+	schedules, err := g.store.LoadSchedules()
+	if err != nil {
+		return err
+	}
+
+	g.schedules.Lock()
+	defer g.schedules.Unlock()
+
+	g.schedules.c = c
+	now := time.Now()
+	for _, s := range schedules {
+		if s.id >= g.schedules.cur {
+			g.schedules.cur = s.id + 1
+		}
+		s.nextRun = s.next(now)
+		g.startSchedule(s)
+	}
+	return nil
+}
+
+// AddSchedule checks that the schedule's jobs could be created before
+// starting it
+func (g *jobGroup) AddSchedule(s *schedule) error {
+	g.schedules.Lock()
+	defer g.schedules.Unlock()
+
+	if g.schedules.c == nil {
+		return errSchedulerNotRun
+	}
+
+	j, err := s.request.newJob(g.schedules.c)
+	if err != nil {
+		return err
+	}
+	j.Cleanup()
+
+	if g.schedules.cur == 0 {
+		g.schedules.cur = 1
+	}
+	s.id = g.schedules.cur
+	g.schedules.cur++
+	s.nextRun = s.next(time.Now())
+	g.startSchedule(s)
+	return g.saveSchedules()
+}
+
+func (g *jobGroup) GetSchedule(id int) *schedule {
+	g.schedules.Lock()
+	defer g.schedules.Unlock()
+
+	return g.schedules.schedules[id]
+}
+
+// AllSchedules returns the group's schedules ordered by id
+func (g *jobGroup) AllSchedules() []*schedule {
+	g.schedules.Lock()
+	defer g.schedules.Unlock()
+
+	schedules := []*schedule{}
+	for _, s := range g.schedules.schedules {
+		schedules = append(schedules, s)
+	}
+	sort.Sort(schedulesByID(schedules))
+	return schedules
+}
+
+// RemoveSchedule stops a schedule, leaving any jobs it created alone
+func (g *jobGroup) RemoveSchedule(id int) error {
+	g.schedules.Lock()
+	defer g.schedules.Unlock()
+
+	s, ok := g.schedules.schedules[id]
+	if !ok {
+		return errNoSuchSchedule
+	}
+	close(s.stop)
+	delete(g.schedules.schedules, id)
+	return g.saveSchedules()
+}
+
+// startSchedule must be called with the schedules lock held
+func (g *jobGroup) startSchedule(s *schedule) {
+	s.stop = make(chan struct{})
+	g.schedules.schedules[s.id] = s
+
+	go func() {
+		for {
+			g.schedules.Lock()
+			next := s.nextRun
+			g.schedules.Unlock()
+			if next.IsZero() {
+				return
+			}
+
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case now := <-timer.C:
+				g.fireSchedule(s, now)
+			case <-s.stop:
+				timer.Stop()
+				return
+			case <-g.closed:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// fireSchedule creates the schedule's job unless its overlap policy says
+// otherwise
+func (g *jobGroup) fireSchedule(s *schedule, now time.Time) {
+	g.schedules.Lock()
+	defer g.schedules.Unlock()
+
+	s.nextRun = s.next(now)
+
+	var last *job
+	if s.lastJob >= 0 {
+		last = g.Get(s.lastJob)
+	}
+	overlapping := false
+	if last != nil {
+		select {
+		case <-last.Done():
+		default:
+			overlapping = true
+		}
+	}
+
+	switch {
+	case !overlapping || s.request.Overlap == "allow":
+		g.runScheduled(s, now)
+	case s.request.Overlap == "queue" && !s.pending:
+		s.pending = true
+		go func() {
+			select {
+			case <-last.Done():
+			case <-s.stop:
+				return
+			case <-g.closed:
+				return
+			}
+
+			g.schedules.Lock()
+			defer g.schedules.Unlock()
+			s.pending = false
+			g.runScheduled(s, time.Now())
+			g.saveSchedules()
+		}()
+	default:
+		s.skipped++
+	}
+
+	g.saveSchedules()
+}
+
+// runScheduled must be called with the schedules lock held
+func (g *jobGroup) runScheduled(s *schedule, now time.Time) {
+	c := g.schedules.c
+	logger := c.logger.WithFields(logrus.Fields{
+		"group":    g.name,
+		"schedule": s.id,
+	})
+
+	j, err := s.request.newJob(c)
+	if err != nil {
+		logger.WithField("err", err).Warn("Failed to create scheduled job")
+		return
+	}
+	j.schedule = s.id
+
+	if c.noop {
+		g.Add(j)
+	} else if err := g.Submit(j); err != nil {
+		j.Cleanup()
+		s.skipped++
+		logger.WithField("err", err).Warn("Failed to submit scheduled job")
+		return
+	}
+
+	s.lastRun = now.UTC()
+	s.lastJob = j.id
+	s.runs++
+}
+
+// saveSchedules must be called with the schedules lock held
+func (g *jobGroup) saveSchedules() error {
+	schedules := []*schedule{}
+	for _, s := range g.schedules.schedules {
+		schedules = append(schedules, s)
+	}
+	sort.Sort(schedulesByID(schedules))
+	return g.store.SaveSchedules(schedules)
+}
+
+func (g *jobGroup) scheduleHref(id int) string {
+	if g.name == "main" {
+		return fmt.Sprintf("/schedules/%v", id)
+	}
+	return fmt.Sprintf("/groups/%v/schedules/%v", g.name, id)
+}
+
+// toJSON must be called with the schedules lock held
+func (s *schedule) toJSON(g *jobGroup) *ScheduleJSON {
+	sj := &ScheduleJSON{
+		ID:      s.id,
+		Cron:    s.request.Cron,
+		Every:   s.request.Every,
+		Overlap: s.request.Overlap,
+		Script:  s.request.Script,
+		Create:  s.createTime.String(),
+		Runs:    s.runs,
+		Skipped: s.skipped,
+		Pending: s.pending,
+		Owner:   s.request.owner,
+		Href:    g.scheduleHref(s.id),
+	}
+
+	if !s.lastRun.IsZero() {
+		sj.LastRun = s.lastRun.String()
+	}
+	if !s.nextRun.IsZero() {
+		sj.NextRun = s.nextRun.UTC().String()
+	}
+	if s.lastJob >= 0 {
+		lastJob := s.lastJob
+		sj.LastJob = &lastJob
+	}
+	return sj
+}
+
+// ScheduleJSON is how a schedule is described to clients
+type ScheduleJSON struct {
+	ID      int    `json:"id"`
+	Cron    string `json:"cron,omitempty"`
+	Every   string `json:"every,omitempty"`
+	Overlap string `json:"overlap"`
+	Script  string `json:"script"`
+	Create  string `json:"create"`
+	LastRun string `json:"last_run,omitempty"`
+	NextRun string `json:"next_run,omitempty"`
+	LastJob *int   `json:"last_job,omitempty"`
+	Runs    int    `json:"runs"`
+	Skipped int    `json:"skipped"`
+	Pending bool   `json:"pending,omitempty"`
+	Owner   string `json:"owner,omitempty"`
+	Href    string `json:"href"`
+}
+
+// ScheduleResponse is the envelope for schedules, like JobResponse is
+// for jobs
+type ScheduleResponse struct {
+	Schedules []*ScheduleJSON `json:"schedules"`
+}
+
+func newScheduleResponse(g *jobGroup, schedules []*schedule) *ScheduleResponse {
+	g.schedules.Lock()
+	defer g.schedules.Unlock()
+
+	mapped := []*ScheduleJSON{}
+	for _, s := range schedules {
+		mapped = append(mapped, s.toJSON(g))
+	}
+	return &ScheduleResponse{Schedules: mapped}
+}
+
+type schedulesByID []*schedule
+
+func (s schedulesByID) Len() int           { return len(s) }
+func (s schedulesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s schedulesByID) Less(i, j int) bool { return s[i].id < s[j].id }
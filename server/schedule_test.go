@@ -0,0 +1,121 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestSchedule(t *testing.T, g *jobGroup, overlap string) *schedule {
+	s, err := newSchedule(&scheduleRequest{
+		Every:      "1h",
+		Overlap:    overlap,
+		jobRequest: jobRequest{Script: "echo scheduled", Env: map[string]string{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = g.AddSchedule(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScheduleOverlapPolicies(t *testing.T) {
+	for overlap, expected := range map[string]struct{ runs, skipped int }{
+		"skip":  {1, 1},
+		"queue": {1, 0},
+		"allow": {2, 0},
+	} {
+		g, err := NewJobGroup("schedule-"+overlap, "memory", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.StartScheduler(testServerContext)
+
+		// jobs are never run by the noop test context, so the first one
+		// is still going when the schedule fires again
+		s := newTestSchedule(t, g, overlap)
+		g.fireSchedule(s, time.Now())
+		g.fireSchedule(s, time.Now())
+
+		g.schedules.Lock()
+		if s.runs != expected.runs || s.skipped != expected.skipped {
+			t.Errorf("%v: expected %+v, got %v runs, %v skipped",
+				overlap, expected, s.runs, s.skipped)
+		}
+		if overlap == "queue" && !s.pending {
+			t.Errorf("expected a queued run to be pending")
+		}
+		g.schedules.Unlock()
+
+		j := g.Get(s.lastJob)
+		if j == nil || j.schedule != s.id {
+			t.Errorf("%v: expected the last job to link back to the schedule", overlap)
+		}
+		RemoveJobGroup(g.name)
+	}
+}
+
+func TestScheduleRunsAgainOnceIdle(t *testing.T) {
+	g, err := NewJobGroup("schedule-idle", "memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+	g.StartScheduler(testServerContext)
+
+	s := newTestSchedule(t, g, "skip")
+	g.fireSchedule(s, time.Now())
+	first := g.Get(s.lastJob)
+	first.finish()
+	g.fireSchedule(s, time.Now())
+
+	g.schedules.Lock()
+	defer g.schedules.Unlock()
+	if s.runs != 2 || s.lastJob == first.id {
+		t.Errorf("expected a second run, got %v", s.runs)
+	}
+	if s.nextRun.Before(s.lastRun) {
+		t.Errorf("expected the next run after the last one")
+	}
+}
+
+func TestDiskJobGroupStoreReloadsSchedules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtot-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g, err := NewJobGroup("disk-schedules", "disk", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.StartScheduler(testServerContext)
+	s := newTestSchedule(t, g, "allow")
+	g.fireSchedule(s, time.Now())
+	RemoveJobGroup(g.name)
+
+	g, err = NewJobGroup("disk-schedules", "disk", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveJobGroup(g.name)
+	err = g.StartScheduler(testServerContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := g.GetSchedule(s.id)
+	if reloaded == nil {
+		t.Fatalf("schedule %v was not reloaded", s.id)
+	}
+	if reloaded.every != time.Hour || reloaded.runs != 1 ||
+		reloaded.request.Script != "echo scheduled" || reloaded.nextRun.IsZero() {
+		t.Errorf("unexpected schedule %+v", reloaded)
+	}
+}
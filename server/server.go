@@ -3,15 +3,19 @@ package server
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
-	"runtime"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -26,23 +30,40 @@ var (
 	}
 	defaultRootMap = &map[string]*map[string]string{
 		"links": &map[string]string{
-			"jobs":       "/jobs{?state}",
-			"jobs.by_id": "/jobs/{jobs.id}",
-			"ping":       "/ping",
+			"jobs":            "/jobs{?state}",
+			"jobs.by_id":      "/jobs/{jobs.id}",
+			"jobs.out":        "/jobs/{jobs.id}/out{?offset}",
+			"jobs.err":        "/jobs/{jobs.id}/err{?offset}",
+			"jobs.log":        "/jobs/{jobs.id}/log{?offset}",
+			"jobs.entries":    "/jobs/{jobs.id}/log.ndjson{?offset}",
+			"ping":            "/ping",
+			"events":          "/events{?id,state,output}",
+			"groups":          "/groups",
+			"groups.jobs":     "/groups/{groups.name}/jobs{?state}",
+			"schedules":       "/schedules",
+			"schedules.by_id": "/schedules/{schedules.id}",
+			"commands":        "/commands",
+			"commands.run":    "/commands/{commands.name}{?param}",
 		},
 	}
 	defaultNoSuchJob     = &map[string]string{"error": "no such job"}
+	defaultNoSuchGroup   = &map[string]string{"error": "no such group"}
+	validGroupName       = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
 	defaultServerContext = &serverContext{
 		logger:           logrus.New(),
 		theBeginning:     time.Now(),
-		defaultJobFields: "out,err,create,start,complete,filename",
+		defaultJobFields: "out,err,create,start,complete,filename,dir,env",
 
-		addr:   os.Getenv("RTOT_ADDR"),
-		secret: os.Getenv("RTOT_SECRET"),
+		addr:          os.Getenv("RTOT_ADDR"),
+		secret:        os.Getenv("RTOT_SECRET"),
+		storeType:     os.Getenv("RTOT_STORE"),
+		stateDir:      os.Getenv("RTOT_STATE_DIR"),
+		tlsClientAuth: os.Getenv("RTOT_TLS_CLIENT_AUTH"),
 
 		notAuthorized: defaultNotAuthorized,
 		rootMap:       defaultRootMap,
 		noSuchJob:     defaultNoSuchJob,
+		noSuchGroup:   defaultNoSuchGroup,
 
 		fl:   flag.NewFlagSet("rtot", flag.ExitOnError),
 		args: os.Args[1:],
@@ -56,9 +77,32 @@ type serverContext struct {
 	defaultJobFields string
 	addr             string
 	secret           string
+	storeType        string
+	stateDir         string
+	reapPolicy       reapPolicy
+	jobTimeout       time.Duration
+	killGrace        time.Duration
+	maxConcurrent    int
+	maxQueue         int
+	allowedUsers     string
+	allowedGroups    string
+	tlsCert          string
+	tlsKey           string
+	tlsClientCA      string
+	tlsClientAuth    string
+	tokensFile       string
+	tokens           *tokenStore
+	hmacOnly         bool
+	hmacSkew         time.Duration
+	nonces           *nonceCache
+	commandsDir      string
+	commands         *commandCatalog
+	commandsOnly     bool
+	outputLimits     outputLimits
 	notAuthorized    *map[string]string
 	rootMap          *map[string]*map[string]string
 	noSuchJob        *map[string]string
+	noSuchGroup      *map[string]string
 
 	fl   *flag.FlagSet
 	args []string
@@ -95,6 +139,14 @@ func ServerMain(c *serverContext) int {
 		c.addr = ":8457"
 	}
 
+	if c.storeType == "" {
+		c.storeType = "memory"
+	}
+
+	if c.tlsClientAuth == "" {
+		c.tlsClientAuth = "either"
+	}
+
 	logFmt := os.Getenv("RTOT_LOG_FORMAT")
 	if logFmt == "" {
 		logFmt = "text"
@@ -107,6 +159,76 @@ func ServerMain(c *serverContext) int {
 		"a", c.addr, "HTTP Server address [RTOT_ADDR]")
 	c.fl.StringVar(&c.secret,
 		"s", c.secret, "Secret string for secret stuff [RTOT_SECRET]")
+	c.fl.StringVar(&c.storeType,
+		"S", c.storeType, "Job store type (memory, disk) [RTOT_STORE]")
+	c.fl.StringVar(&c.stateDir,
+		"d", c.stateDir, "State directory for the disk job store [RTOT_STATE_DIR]")
+	c.fl.DurationVar(&c.reapPolicy.maxAge,
+		"gc-max-age", envDuration("RTOT_GC_MAX_AGE", c.reapPolicy.maxAge),
+		"Remove completed jobs older than this, 0 to disable [RTOT_GC_MAX_AGE]")
+	c.fl.IntVar(&c.reapPolicy.maxJobs,
+		"gc-max-jobs", envInt("RTOT_GC_MAX_JOBS", c.reapPolicy.maxJobs),
+		"Keep at most this many completed jobs, 0 to disable [RTOT_GC_MAX_JOBS]")
+	c.fl.Int64Var(&c.reapPolicy.maxOutput,
+		"gc-max-output", int64(envInt("RTOT_GC_MAX_OUTPUT", int(c.reapPolicy.maxOutput))),
+		"Keep at most this many bytes of completed job output, 0 to disable [RTOT_GC_MAX_OUTPUT]")
+	c.fl.DurationVar(&c.reapPolicy.interval,
+		"gc-interval", envDuration("RTOT_GC_INTERVAL", time.Minute),
+		"How often to garbage collect completed jobs [RTOT_GC_INTERVAL]")
+	c.fl.DurationVar(&c.jobTimeout,
+		"job-timeout", envDuration("RTOT_JOB_TIMEOUT", c.jobTimeout),
+		"Default job timeout, 0 for none [RTOT_JOB_TIMEOUT]")
+	c.fl.DurationVar(&c.killGrace,
+		"kill-grace", envDuration("RTOT_KILL_GRACE", 5*time.Second),
+		"How long timed out jobs get between SIGTERM and SIGKILL [RTOT_KILL_GRACE]")
+	c.fl.IntVar(&c.maxConcurrent,
+		"max-concurrent", envInt("RTOT_MAX_CONCURRENT", c.maxConcurrent),
+		"Most jobs to run at once, 0 for no limit [RTOT_MAX_CONCURRENT]")
+	c.fl.IntVar(&c.maxQueue,
+		"max-queue", envInt("RTOT_MAX_QUEUE", c.maxQueue),
+		"Most jobs to keep waiting to run, 0 for no limit [RTOT_MAX_QUEUE]")
+	c.fl.StringVar(&c.allowedUsers,
+		"allowed-users", os.Getenv("RTOT_ALLOWED_USERS"),
+		"Comma-separated users jobs may run as [RTOT_ALLOWED_USERS]")
+	c.fl.StringVar(&c.allowedGroups,
+		"allowed-groups", os.Getenv("RTOT_ALLOWED_GROUPS"),
+		"Comma-separated groups jobs may run as [RTOT_ALLOWED_GROUPS]")
+	c.fl.StringVar(&c.tlsCert,
+		"tls-cert", os.Getenv("RTOT_TLS_CERT"),
+		"TLS certificate file, serving HTTPS when given [RTOT_TLS_CERT]")
+	c.fl.StringVar(&c.tlsKey,
+		"tls-key", os.Getenv("RTOT_TLS_KEY"),
+		"TLS private key file [RTOT_TLS_KEY]")
+	c.fl.StringVar(&c.tlsClientCA,
+		"tls-client-ca", os.Getenv("RTOT_TLS_CLIENT_CA"),
+		"CA bundle for verifying client certificates [RTOT_TLS_CLIENT_CA]")
+	c.fl.StringVar(&c.tlsClientAuth,
+		"tls-client-auth", c.tlsClientAuth,
+		"Whether a client needs a certificate or secret (either) or both (both) [RTOT_TLS_CLIENT_AUTH]")
+	c.fl.StringVar(&c.tokensFile,
+		"tokens", os.Getenv("RTOT_TOKENS"),
+		"JSON file of scoped API tokens, reloaded on SIGHUP [RTOT_TOKENS]")
+	c.fl.BoolVar(&c.hmacOnly,
+		"hmac-only", os.Getenv("RTOT_HMAC_ONLY") == "true",
+		"Only accept signed requests, refusing the plain secret [RTOT_HMAC_ONLY]")
+	c.fl.DurationVar(&c.hmacSkew,
+		"hmac-skew", envDuration("RTOT_HMAC_SKEW", 5*time.Minute),
+		"How far signed request timestamps may be from now [RTOT_HMAC_SKEW]")
+	c.fl.StringVar(&c.commandsDir,
+		"commands", os.Getenv("RTOT_COMMANDS"),
+		"Directory of catalog commands, reloaded on SIGHUP [RTOT_COMMANDS]")
+	c.fl.BoolVar(&c.commandsOnly,
+		"commands-only", os.Getenv("RTOT_COMMANDS_ONLY") == "true",
+		"Only run catalog commands, refusing submitted scripts [RTOT_COMMANDS_ONLY]")
+	c.fl.Int64Var(&c.outputLimits.memory,
+		"output-memory", int64(envInt("RTOT_OUTPUT_MEMORY", 1<<20)),
+		"Bytes of each job output stream to keep in memory before spooling to disk, 0 for all [RTOT_OUTPUT_MEMORY]")
+	c.fl.Int64Var(&c.outputLimits.max,
+		"output-max", int64(envInt("RTOT_OUTPUT_MAX", 64<<20)),
+		"Most bytes of each job output stream to keep, 0 for no limit [RTOT_OUTPUT_MAX]")
+	c.fl.StringVar(&c.outputLimits.spoolDir,
+		"spool-dir", os.Getenv("RTOT_SPOOL_DIR"),
+		"Directory for spooled job output, defaulting to the system temp dir [RTOT_SPOOL_DIR]")
 	versionFlag := c.fl.Bool("v", false, "Show version and exit")
 
 	c.fl.Parse(c.args)
@@ -120,37 +242,103 @@ func ServerMain(c *serverContext) int {
 		os.Exit(0)
 	}
 
+	var (
+		mainGroup *jobGroup
+		err       error
+	)
+
 	if c.secret == "" {
 		c.secret = makeSecret()
 		c.logger.WithField("secret", c.secret).Info("No secret given, so generated one.")
 	}
 
-	_, err := NewJobGroup("main", "memory")
+	err = c.checkTLS()
+	if err != nil {
+		c.logger.WithField("err", err).Warn("Failed to init TLS")
+		os.Exit(1)
+	}
+
+	c.tokens, err = newTokenStore(c.tokensFile)
+	if err != nil {
+		c.logger.WithField("err", err).Warn("Failed to load tokens")
+		os.Exit(1)
+	}
+
+	c.commands, err = newCommandCatalog(c.commandsDir)
+	if err != nil {
+		c.logger.WithField("err", err).Warn("Failed to load commands")
+		os.Exit(1)
+	}
+
+	if !c.noop {
+		go reloadOnHUP(c)
+	}
+
+	mainGroup, err = NewJobGroup("main", c.storeType, c.stateDir)
 	if err != nil {
 		c.logger.WithField("err", err).Warn("Failed to init job store")
 		os.Exit(1)
 	}
 
+	mainGroup.SetLimits(c.maxConcurrent, c.maxQueue)
+	mainGroup.Start(c)
+	mainGroup.StartReaper(&c.reapPolicy, c.logger)
+	err = mainGroup.StartScheduler(c)
+	if err != nil {
+		c.logger.WithField("err", err).Warn("Failed to load schedules")
+		os.Exit(1)
+	}
+	(*c.rootMap)["gc"] = c.reapPolicy.toMap()
+
 	m := NewServer(c)
 
-	c.logger.WithField("addr", c.addr).Info("Serving")
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		c.logger.WithField("err", err).Warn("Failed to init TLS")
+		os.Exit(1)
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"addr": c.addr,
+		"tls":  c.tlsCert != "",
+	}).Info("Serving")
 	http.Handle("/", m)
 	if !c.noop {
-		http.ListenAndServe(c.addr, nil)
+		server := &http.Server{Addr: c.addr, TLSConfig: tlsConfig}
+		if c.tlsCert != "" {
+			err = server.ListenAndServeTLS(c.tlsCert, c.tlsKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		c.logger.WithField("err", err).Warn("Stopped serving")
 	}
 	return 0
 }
 
 // NewServer creates a martini.ClassicMartini based on server context
 func NewServer(c *serverContext) *martini.ClassicMartini {
+	if c.nonces == nil {
+		c.nonces = newNonceCache()
+	}
+	if c.hmacSkew <= 0 {
+		c.hmacSkew = 5 * time.Minute
+	}
+	if c.commands == nil {
+		c.commands, _ = newCommandCatalog("")
+	}
+
 	r := martini.NewRouter()
 	m := martini.New()
 	m.Use(func(res http.ResponseWriter, req *http.Request, sc *serverContext, c martini.Context) {
 		start := time.Now()
-		sc.logger.WithFields(logrus.Fields{
+		fields := logrus.Fields{
 			"method": req.Method,
 			"path":   req.URL.Path,
-		}).Info("started")
+		}
+		if subject := clientSubject(req); subject != "" {
+			fields["client"] = subject
+		}
+		sc.logger.WithFields(fields).Info("started")
 
 		rw := res.(martini.ResponseWriter)
 		c.Next()
@@ -167,30 +355,69 @@ func NewServer(c *serverContext) *martini.ClassicMartini {
 
 	cm := &martini.ClassicMartini{m, r}
 	cm.Use(render.Renderer())
-	cm.Use(func(res http.ResponseWriter, req *http.Request) {
+	cm.Use(func(res http.ResponseWriter, req *http.Request, mc martini.Context) {
 		if req.URL.Path == "/ping" && req.Method == "GET" {
 			return
 		}
 
-		if req.Header.Get("Authorization") != "rtot "+c.secret {
+		t := c.authenticate(res, req)
+		if t == nil {
 			http.Error(res, "Not Authorized", http.StatusUnauthorized)
+			return
 		}
+		mc.Map(t)
 	})
 	cm.Use(func(res http.ResponseWriter) {
 		res.Header().Set("Rtot-Version", VersionString)
 	})
 	cm.Map(c)
 
+	var (
+		readJobs   = requireScope("jobs:read")
+		createJobs = requireScope("jobs:create")
+		deleteJobs = requireScope("jobs:delete")
+		admin      = requireScope("server:admin")
+	)
+
 	cm.Get("/", root)
-	cm.Delete("/", die)
+	cm.Delete("/", admin, die)
 
 	cm.Get("/ping", ping)
 
-	cm.Post("/jobs", createJob)
-	cm.Get("/jobs", allJobs)
-	cm.Get("/jobs/:id", getJob)
-	cm.Delete("/jobs", delAllJobs)
-	cm.Delete("/jobs/:id", delJob)
+	cm.Post("/groups", admin, createGroup)
+	cm.Get("/groups", readJobs, allGroups)
+	cm.Get("/groups/:name", readJobs, getGroup)
+	cm.Delete("/groups/:name", admin, delGroup)
+
+	cm.Get("/commands", readJobs, allCommands)
+	cm.Get("/commands/:command", readJobs, getCommand)
+
+	// everything under /jobs is also available for other job groups
+	// under /groups/:name, with plain /jobs belonging to "main"
+	for _, prefix := range []string{"", "/groups/:name"} {
+		cm.Get(prefix+"/events", readJobs, events)
+
+		cm.Post(prefix+"/commands/:command", createJobs, createCommandJob)
+		cm.Post(prefix+"/jobs", createJobs, createJob)
+		cm.Post(prefix+"/jobs/batch", createJobs, createBatch)
+		cm.Post(prefix+"/jobs/batch/:batch/signal", deleteJobs, signalBatch)
+		cm.Get(prefix+"/jobs", readJobs, allJobs)
+		cm.Get(prefix+"/jobs/:id", readJobs, getJob)
+		cm.Get(prefix+"/jobs/:id/out", readJobs, streamJobOutput("out"))
+		cm.Get(prefix+"/jobs/:id/err", readJobs, streamJobOutput("err"))
+		cm.Get(prefix+"/jobs/:id/log", readJobs, streamJobOutput("log"))
+		cm.Get(prefix+"/jobs/:id/log.ndjson", readJobs, streamJobLog)
+		cm.Post(prefix+"/jobs/:id/signal", deleteJobs, signalJob)
+		cm.Post(prefix+"/jobs/:id/stdin", createJobs, writeJobStdin)
+		cm.Post(prefix+"/jobs/:id/reschedule", createJobs, rescheduleJob)
+		cm.Get(prefix+"/jobs/:id/graph", readJobs, getJobGraph)
+		cm.Post(prefix+"/schedules", createJobs, createSchedule)
+		cm.Get(prefix+"/schedules", readJobs, allSchedules)
+		cm.Get(prefix+"/schedules/:id", readJobs, getSchedule)
+		cm.Delete(prefix+"/schedules/:id", deleteJobs, delSchedule)
+		cm.Delete(prefix+"/jobs", deleteJobs, delAllJobs)
+		cm.Delete(prefix+"/jobs/:id", deleteJobs, delJob)
+	}
 
 	return cm
 }
@@ -217,18 +444,191 @@ func die(r render.Render, req *http.Request, c *serverContext) {
 	r.JSON(204, "")
 }
 
-func delJob(r render.Render, req *http.Request, params martini.Params, c *serverContext) {
+func events(r render.Render, res http.ResponseWriter, req *http.Request,
+	params martini.Params, c *serverContext, t *apiToken) {
+
+	filter := &eventFilter{
+		ids:    map[int]bool{},
+		states: map[string]bool{},
+		token:  t,
+	}
+
+	query := req.URL.Query()
+	if idString := query.Get("id"); idString != "" {
+		for _, part := range strings.Split(idString, ",") {
+			i, err := strconv.Atoi(part)
+			if err != nil {
+				sendInvalidJob400(r, part)
+				return
+			}
+			filter.ids[i] = true
+		}
+	}
+
+	if stateString := query.Get("state"); stateString != "" {
+		for _, part := range strings.Split(stateString, ",") {
+			filter.states[part] = true
+		}
+	}
+
+	filter.output, _ = strconv.ParseBool(query.Get("output"))
+
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	sub := jobs.events.Subscribe(filter)
+	defer jobs.events.Unsubscribe(sub)
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(200)
+
+	flusher, _ := res.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case e := <-sub.events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(res, "id: %v\nevent: %v\ndata: %s\n\n", e.ID, e.Type, data)
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+type groupRequest struct {
+	Name          string `json:"name"`
+	Store         string `json:"store"`
+	MaxConcurrent int    `json:"max_concurrent"`
+	MaxQueue      int    `json:"max_queue"`
+}
+
+func createGroup(r render.Render, res http.ResponseWriter, req *http.Request, c *serverContext) {
+	gr := &groupRequest{Store: c.storeType}
+	err := json.NewDecoder(req.Body).Decode(gr)
+	if err != nil {
+		sendErrors(r, 400, "invalid_json", err.Error())
+		return
+	}
+
+	if !validGroupName.MatchString(gr.Name) || gr.Name == "." || gr.Name == ".." {
+		sendInvalidParam400(r, "name", gr.Name)
+		return
+	}
+
+	fresh := true
+	if gr.Store == "disk" && c.stateDir != "" {
+		_, err = os.Stat(filepath.Join(c.stateDir, gr.Name))
+		fresh = os.IsNotExist(err)
+	}
+
+	g, err := NewJobGroup(gr.Name, gr.Store, c.stateDir)
+	if err == errGroupExists {
+		sendErrors(r, 409, "group_exists", fmt.Sprintf("group %q already exists", gr.Name))
+		return
+	}
+	if err != nil {
+		sendErrors(r, 400, "invalid_group", err.Error())
+		return
+	}
+
+	g.SetLimits(gr.MaxConcurrent, gr.MaxQueue)
+	g.Start(c)
+	g.StartReaper(&c.reapPolicy, c.logger)
+	err = g.StartScheduler(c)
+	if err != nil {
+		// leave state a store found already there for someone to look at
+		RemoveJobGroup(g.name)
+		if fresh {
+			g.Destroy()
+		}
+		send500(r, err)
+		return
+	}
+
+	res.Header().Set("Location", g.Href())
+	r.JSON(201, newJobGroupResponse([]*jobGroup{g}))
+}
+
+func allGroups(r render.Render) {
+	r.JSON(200, newJobGroupResponse(AllJobGroups()))
+}
+
+func getGroup(r render.Render, params martini.Params, c *serverContext) {
+	g, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	r.JSON(200, newJobGroupResponse([]*jobGroup{g}))
+}
+
+func delGroup(r render.Render, params martini.Params, c *serverContext) {
+	if params["name"] == "main" {
+		sendErrors(r, 400, "main_group", "the main group can't be deleted")
+		return
+	}
+
+	g, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	RemoveJobGroup(g.name)
+	g.dequeueAll()
+	for _, job := range g.Getall("") {
+		if !c.noop {
+			g.Kill(job.id)
+		}
+		g.Remove(job.id)
+	}
+
+	if err := g.Destroy(); err != nil {
+		send500(r, err)
+		return
+	}
+
+	r.JSON(204, "")
+}
+
+func delJob(r render.Render, req *http.Request, params martini.Params,
+	c *serverContext, t *apiToken) {
+
 	i, err := strconv.Atoi(params["id"])
 	if err != nil {
 		sendInvalidJob400(r, params["id"])
 		return
 	}
 
-	jobs, ok := getMainJobGroupOr500(r)
+	jobs, ok := getJobGroupOr404(r, params, c)
 	if !ok {
 		return
 	}
 
+	j := jobs.Get(i)
+	if j == nil || !t.canSee(j) {
+		r.JSON(404, c.noSuchJob)
+		return
+	}
+
+	if !c.noop && !j.isDone() {
+		jobs.Kill(i)
+	}
+
 	if !jobs.Remove(i) {
 		r.JSON(404, c.noSuchJob)
 		return
@@ -238,7 +638,7 @@ func delJob(r render.Render, req *http.Request, params martini.Params, c *server
 }
 
 func getJob(r render.Render, res http.ResponseWriter,
-	req *http.Request, params martini.Params, c *serverContext) {
+	req *http.Request, params martini.Params, c *serverContext, t *apiToken) {
 
 	i, err := strconv.Atoi(params["id"])
 	if err != nil {
@@ -246,7 +646,17 @@ func getJob(r render.Render, res http.ResponseWriter,
 		return
 	}
 
-	jobs, ok := getMainJobGroupOr500(r)
+	wait, ok := waitParam(r, req)
+	if !ok {
+		return
+	}
+
+	offset, limit, ok := outputRangeParams(r, req)
+	if !ok {
+		return
+	}
+
+	jobs, ok := getJobGroupOr404(r, params, c)
 	if !ok {
 		return
 	}
@@ -254,121 +664,981 @@ func getJob(r render.Render, res http.ResponseWriter,
 	fields := fieldsMapFromRequest(req, c)
 
 	j := jobs.Get(i)
-	if j == nil {
+	if j == nil || !t.canSee(j) {
 		r.JSON(404, newJobResponse([]*job{}, fields))
 		return
 	}
 
 	res.Header().Set("Location", j.Href())
+	waitForJobs(req, []*job{j}, wait)
 
-	if j.state != "complete" {
-		r.JSON(202, newJobResponse([]*job{j}, fields))
+	if !j.isDone() {
+		r.JSON(202, newRangedJobResponse([]*job{j}, fields, offset, limit))
 		return
 	}
 
-	r.JSON(200, newJobResponse([]*job{j}, fields))
+	r.JSON(200, newRangedJobResponse([]*job{j}, fields, offset, limit))
+}
+
+// outputRangeParams are the offset and limit for the output included in
+// job responses, which default to all of it
+func outputRangeParams(r render.Render, req *http.Request) (int64, int64, bool) {
+	var (
+		offset int64
+		limit  int64 = -1
+		err    error
+	)
+
+	query := req.URL.Query()
+	if offsetString := query.Get("offset"); offsetString != "" {
+		offset, err = strconv.ParseInt(offsetString, 10, 64)
+		if err != nil || offset < 0 {
+			sendInvalidParam400(r, "offset", offsetString)
+			return 0, 0, false
+		}
+	}
+
+	if limitString := query.Get("limit"); limitString != "" {
+		limit, err = strconv.ParseInt(limitString, 10, 64)
+		if err != nil || limit < 0 {
+			sendInvalidParam400(r, "limit", limitString)
+			return 0, 0, false
+		}
+	}
+
+	return offset, limit, true
+}
+
+type signalRequest struct {
+	Signal string `json:"signal"`
+}
+
+type rescheduleRequest struct {
+	RunAt string `json:"run_at"`
+	Delay string `json:"delay"`
 }
 
-func createJob(r render.Render, req *http.Request, c *serverContext) {
-	bodyBytes, err := ioutil.ReadAll(req.Body)
+// signalJob sends a signal to a job's process group without removing the
+// job, or cancels it if it hasn't started yet.  Unless told otherwise the
+// job is stopped with TERM and then KILL after the kill grace.
+func signalJob(r render.Render, res http.ResponseWriter, req *http.Request,
+	params martini.Params, c *serverContext, t *apiToken) {
+
+	i, err := strconv.Atoi(params["id"])
 	if err != nil {
-		send500(r, err)
+		sendInvalidJob400(r, params["id"])
 		return
 	}
 
-	jobs, ok := getMainJobGroupOr500(r)
+	name := req.URL.Query().Get("signal")
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if name == "" && mediaType == "application/json" {
+		sr := &signalRequest{}
+		err = json.NewDecoder(req.Body).Decode(sr)
+		if err != nil {
+			sendErrors(r, 400, "invalid_json", err.Error())
+			return
+		}
+		name = sr.Signal
+	}
+
+	sig, ok := signalParam(r, name)
 	if !ok {
 		return
 	}
 
-	j, err := newJob(string(bodyBytes))
-	if err != nil {
-		send500(r, err)
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
 		return
 	}
 
-	jobs.Add(j)
-	if !c.noop {
-		go func() {
-			j.Run()
-			runtime.Goexit()
-		}()
+	j := jobs.Get(i)
+	if j == nil || !t.canSee(j) {
+		r.JSON(404, c.noSuchJob)
+		return
 	}
 
-	r.JSON(201, newJobResponse([]*job{j}, fieldsMapFromRequest(req, c)))
+	switch err = signalOrStop(jobs, i, sig); err {
+	case nil:
+	case errJobDone:
+		sendErrors(r, 409, "job_done", fmt.Sprintf("job %v is already done", i))
+		return
+	case errJobNotRunning:
+		sendErrors(r, 409, "job_not_running", fmt.Sprintf("job %v isn't running", i))
+		return
+	default:
+		send500(r, err)
+		return
+	}
+
+	res.Header().Set("Location", j.Href())
+	fields := fieldsMapFromRequest(req, c)
+	if !j.isDone() {
+		r.JSON(202, newJobResponse([]*job{j}, fields))
+		return
+	}
+	r.JSON(200, newJobResponse([]*job{j}, fields))
 }
 
-func delAllJobs(r render.Render, req *http.Request, c *serverContext) {
-	jobs, ok := getMainJobGroupOr500(r)
+// getJobGraph returns every job connected to a job by dependencies and
+// the dependencies between them
+func getJobGraph(r render.Render, req *http.Request, params martini.Params,
+	c *serverContext, t *apiToken) {
+
+	i, err := strconv.Atoi(params["id"])
+	if err != nil {
+		sendInvalidJob400(r, params["id"])
+		return
+	}
+
+	jobs, ok := getJobGroupOr404(r, params, c)
 	if !ok {
 		return
 	}
 
-	for _, job := range jobs.Getall(req.URL.Query().Get("state")) {
-		if !c.noop {
-			jobs.Kill(job.id)
-		}
-		jobs.Remove(job.id)
+	j := jobs.Get(i)
+	if j == nil || !t.canSee(j) {
+		r.JSON(404, c.noSuchJob)
+		return
 	}
 
-	r.JSON(204, "")
+	graphJobs, edges := jobs.graph(j)
+	fields := fieldsMapFromRequest(req, c)
+	gr := &GraphResponse{Jobs: []*JobJSON{}, Edges: edges}
+	for _, gj := range t.visibleJobs(graphJobs) {
+		gr.Jobs = append(gr.Jobs, gj.toJSON(fields))
+	}
+	r.JSON(200, gr)
 }
 
-func allJobs(r render.Render, req *http.Request, c *serverContext) {
-	jobs, ok := getMainJobGroupOr500(r)
+// rescheduleJob changes when a scheduled job will run, given a run_at
+// time or a delay from now either as params or in a JSON body.  To run
+// it right away, give a delay of 0.
+func rescheduleJob(r render.Render, res http.ResponseWriter, req *http.Request,
+	params martini.Params, c *serverContext, t *apiToken) {
+
+	i, err := strconv.Atoi(params["id"])
+	if err != nil {
+		sendInvalidJob400(r, params["id"])
+		return
+	}
+
+	rr := &rescheduleRequest{
+		RunAt: req.URL.Query().Get("run_at"),
+		Delay: req.URL.Query().Get("delay"),
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if rr.RunAt == "" && rr.Delay == "" && mediaType == "application/json" {
+		err = json.NewDecoder(req.Body).Decode(rr)
+		if err != nil {
+			sendErrors(r, 400, "invalid_json", err.Error())
+			return
+		}
+	}
+	if rr.RunAt == "" && rr.Delay == "" {
+		sendInvalidParam400(r, "run_at", "")
+		return
+	}
+
+	runAt, err := parseRunAt(rr.RunAt, rr.Delay)
+	if err != nil {
+		sendJobRequestError(r, err)
+		return
+	}
+
+	jobs, ok := getJobGroupOr404(r, params, c)
 	if !ok {
 		return
 	}
 
-	r.JSON(200, newJobResponse(jobs.Getall(req.URL.Query().Get("state")),
-		fieldsMapFromRequest(req, c)))
-}
+	j := jobs.Get(i)
+	if j == nil || !t.canSee(j) {
+		r.JSON(404, c.noSuchJob)
+		return
+	}
 
-func send500(r render.Render, err error) {
-	r.JSON(500, map[string]string{
-		"error": fmt.Sprintf("nope. %v", err),
-	})
-	return
-}
+	switch err = jobs.Reschedule(i, runAt); err {
+	case nil:
+	case errJobNotScheduled:
+		sendErrors(r, 409, "job_not_scheduled", fmt.Sprintf("job %v is not scheduled", i))
+		return
+	default:
+		send500(r, err)
+		return
+	}
 
-func sendInvalidJob400(r render.Render, i string) {
-	r.JSON(400, map[string]string{
-		"error":   "invalid job number",
-		"message": fmt.Sprintf("what is %q?", i),
-	})
-	return
+	res.Header().Set("Location", j.Href())
+	r.JSON(200, newJobResponse([]*job{j}, fieldsMapFromRequest(req, c)))
 }
 
-func getMainJobGroupOr500(r render.Render) (*jobGroup, bool) {
-	jobs := GetJobGroup("main")
-	if jobs == nil {
-		r.JSON(500, &errorsResponse{
-			Errors: []*errorsResponseItem{
-				&errorsResponseItem{
-					Message: "missing main job group",
-					Code:    "0",
-				},
-			},
-		})
-		return nil, false
+// writeJobStdin copies the request body to the stdin of a running job
+// that was created with stdin_open, closing its stdin afterwards when
+// close=true
+func writeJobStdin(r render.Render, req *http.Request, params martini.Params,
+	c *serverContext, t *apiToken) {
+
+	i, err := strconv.Atoi(params["id"])
+	if err != nil {
+		sendInvalidJob400(r, params["id"])
+		return
 	}
-	return jobs, true
-}
 
-func fieldsMapFromRequest(req *http.Request, c *serverContext) *map[string]int {
-	fieldsSlice, ok := req.URL.Query()["fields"]
-	if !ok {
-		fieldsSlice = []string{c.defaultJobFields}
+	closeStdin := false
+	if closeString := req.URL.Query().Get("close"); closeString != "" {
+		closeStdin, err = strconv.ParseBool(closeString)
+		if err != nil {
+			sendInvalidParam400(r, "close", closeString)
+			return
+		}
 	}
-	return fieldsMapFromString(fieldsSlice[0])
-}
 
-func fieldsMapFromString(f string) *map[string]int {
-	fields := &map[string]int{}
-	for _, part := range strings.Split(f, ",") {
-		(*fields)[part] = 1
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
 	}
-	return fields
+
+	j := jobs.Get(i)
+	if j == nil || !t.canSee(j) {
+		r.JSON(404, c.noSuchJob)
+		return
+	}
+
+	if j.stdin == nil {
+		sendErrors(r, 409, "stdin_not_open", fmt.Sprintf("job %v wasn't created with stdin_open", i))
+		return
+	}
+
+	if !j.hasStarted() {
+		sendErrors(r, 409, "job_not_running", fmt.Sprintf("job %v hasn't started yet", i))
+		return
+	}
+
+	_, err = io.Copy(j.stdin, req.Body)
+	if err != nil {
+		sendErrors(r, 409, "stdin_closed", err.Error())
+		return
+	}
+
+	if closeStdin {
+		j.stdin.CloseWhenWritten()
+	}
+
+	r.JSON(204, "")
+}
+
+// streamJobOutput builds a handler that writes the named output stream
+// of a job as it is produced, finishing once the job completes
+func streamJobOutput(stream string) martini.Handler {
+	return func(r render.Render, res http.ResponseWriter,
+		req *http.Request, params martini.Params, c *serverContext, t *apiToken) {
+
+		i, err := strconv.Atoi(params["id"])
+		if err != nil {
+			sendInvalidJob400(r, params["id"])
+			return
+		}
+
+		offset := 0
+		if offsetString := req.URL.Query().Get("offset"); offsetString != "" {
+			offset, err = strconv.Atoi(offsetString)
+			if err != nil || offset < 0 {
+				sendInvalidParam400(r, "offset", offsetString)
+				return
+			}
+		}
+
+		jobs, ok := getJobGroupOr404(r, params, c)
+		if !ok {
+			return
+		}
+
+		j := jobs.Get(i)
+		if j == nil || !t.canSee(j) {
+			r.JSON(404, c.noSuchJob)
+			return
+		}
+
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(200)
+
+		buf := j.output(stream)
+		for {
+			data, closed, wait := buf.Since(offset)
+			if len(data) > 0 {
+				_, err = res.Write(data)
+				if err != nil {
+					return
+				}
+				offset += len(data)
+				if f, ok := res.(http.Flusher); ok {
+					f.Flush()
+				}
+				continue
+			}
+
+			if closed {
+				return
+			}
+
+			select {
+			case <-wait:
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// streamJobLog follows a job's combined log as newline-delimited JSON,
+// one entry per line, starting after the first offset entries
+func streamJobLog(r render.Render, res http.ResponseWriter,
+	req *http.Request, params martini.Params, c *serverContext, t *apiToken) {
+
+	i, err := strconv.Atoi(params["id"])
+	if err != nil {
+		sendInvalidJob400(r, params["id"])
+		return
+	}
+
+	offset := 0
+	if offsetString := req.URL.Query().Get("offset"); offsetString != "" {
+		offset, err = strconv.Atoi(offsetString)
+		if err != nil || offset < 0 {
+			sendInvalidParam400(r, "offset", offsetString)
+			return
+		}
+	}
+
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	j := jobs.Get(i)
+	if j == nil || !t.canSee(j) {
+		r.JSON(404, c.noSuchJob)
+		return
+	}
+
+	if !j.outLog.Timed() {
+		sendErrors(r, 404, "no_log", "job was not created with log=true")
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/x-ndjson")
+	res.WriteHeader(200)
+
+	enc := json.NewEncoder(res)
+	for {
+		entries, closed, wait := j.outLog.EntriesSince(offset)
+		for _, e := range entries {
+			if err = enc.Encode(e); err != nil {
+				return
+			}
+		}
+		offset += len(entries)
+		if len(entries) > 0 {
+			if f, ok := res.(http.Flusher); ok {
+				f.Flush()
+			}
+			continue
+		}
+
+		if closed {
+			return
+		}
+
+		select {
+		case <-wait:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func createJob(r render.Render, req *http.Request, params martini.Params,
+	c *serverContext, t *apiToken) {
+
+	if c.commandsOnly {
+		sendErrors(r, 403, "commands_only", "only catalog commands may be run here")
+		return
+	}
+
+	jr, err := newJobRequest(req)
+	if err != nil {
+		sendJobRequestError(r, err)
+		return
+	}
+	jr.owner = t.Name
+
+	submitJob(r, req, params, c, jr)
+}
+
+func createCommandJob(r render.Render, req *http.Request, params martini.Params,
+	c *serverContext, t *apiToken) {
+
+	cmd := c.commands.Get(params["command"])
+	if cmd == nil {
+		sendErrors(r, 404, "no_such_command", fmt.Sprintf("no command %q", params["command"]))
+		return
+	}
+
+	jr, err := newJobRequest(req)
+	if err != nil {
+		sendJobRequestError(r, err)
+		return
+	}
+	jr.owner = t.Name
+	jr.command = cmd
+
+	submitJob(r, req, params, c, jr)
+}
+
+// submitJob builds the requested job and adds it to the job group in the
+// route, running it once the group's queue allows
+func submitJob(r render.Render, req *http.Request, params martini.Params,
+	c *serverContext, jr *jobRequest) {
+
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	j, err := jr.newJob(c)
+	if err != nil {
+		sendJobRequestError(r, err)
+		return
+	}
+
+	if c.noop {
+		if _, err := jobs.dependencies(j); err != nil {
+			j.Cleanup()
+			sendJobRequestError(r, err)
+			return
+		}
+		jobs.Add(j)
+	} else if err := jobs.Submit(j); err != nil {
+		j.Cleanup()
+		if err == errQueueFull {
+			sendErrors(r, 429, "queue_full", err.Error())
+			return
+		}
+		sendJobRequestError(r, err)
+		return
+	}
+
+	r.JSON(201, newJobResponse([]*job{j}, fieldsMapFromRequest(req, c)))
+}
+
+func createSchedule(r render.Render, res http.ResponseWriter, req *http.Request,
+	params martini.Params, c *serverContext, t *apiToken) {
+
+	if c.commandsOnly {
+		sendErrors(r, 403, "commands_only", "only catalog commands may be run here")
+		return
+	}
+
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	sr := &scheduleRequest{}
+	err := json.NewDecoder(req.Body).Decode(sr)
+	if err != nil {
+		sendErrors(r, 400, "invalid_json", err.Error())
+		return
+	}
+	if sr.Env == nil {
+		sr.Env = map[string]string{}
+	}
+	sr.client = clientSubject(req)
+	sr.owner = t.Name
+
+	s, err := newSchedule(sr)
+	if err != nil {
+		sendJobRequestError(r, err)
+		return
+	}
+
+	err = jobs.AddSchedule(s)
+	if err != nil {
+		sendJobRequestError(r, err)
+		return
+	}
+
+	res.Header().Set("Location", jobs.scheduleHref(s.id))
+	r.JSON(201, newScheduleResponse(jobs, []*schedule{s}))
+}
+
+func allSchedules(r render.Render, params martini.Params, c *serverContext, t *apiToken) {
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	visible := []*schedule{}
+	for _, s := range jobs.AllSchedules() {
+		if t.canSeeOwner(s.request.owner) {
+			visible = append(visible, s)
+		}
+	}
+	r.JSON(200, newScheduleResponse(jobs, visible))
+}
+
+func getSchedule(r render.Render, params martini.Params, c *serverContext, t *apiToken) {
+	jobs, s, ok := getScheduleOr404(r, params, c, t)
+	if !ok {
+		return
+	}
+
+	r.JSON(200, newScheduleResponse(jobs, []*schedule{s}))
+}
+
+// delSchedule stops a schedule from creating any more jobs, leaving the
+// ones it already created alone
+func delSchedule(r render.Render, params martini.Params, c *serverContext, t *apiToken) {
+	jobs, s, ok := getScheduleOr404(r, params, c, t)
+	if !ok {
+		return
+	}
+
+	err := jobs.RemoveSchedule(s.id)
+	if err != nil && err != errNoSuchSchedule {
+		send500(r, err)
+		return
+	}
+
+	r.JSON(204, "")
+}
+
+func getScheduleOr404(r render.Render, params martini.Params, c *serverContext,
+	t *apiToken) (*jobGroup, *schedule, bool) {
+
+	i, err := strconv.Atoi(params["id"])
+	if err != nil {
+		sendInvalidParam400(r, "id", params["id"])
+		return nil, nil, false
+	}
+
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return nil, nil, false
+	}
+
+	s := jobs.GetSchedule(i)
+	if s == nil || !t.canSeeOwner(s.request.owner) {
+		sendErrors(r, 404, "no_such_schedule", fmt.Sprintf("no schedule %v", i))
+		return nil, nil, false
+	}
+	return jobs, s, true
+}
+
+// createBatch creates every job in a batch or, if any of them is
+// invalid or they won't all fit in the queue, none of them
+func createBatch(r render.Render, res http.ResponseWriter, req *http.Request,
+	params martini.Params, c *serverContext, t *apiToken) {
+
+	if c.commandsOnly {
+		sendErrors(r, 403, "commands_only", "only catalog commands may be run here")
+		return
+	}
+
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	requests, err := newBatchRequests(req)
+	if err != nil {
+		sendJobRequestError(r, err)
+		return
+	}
+
+	batch := []*job{}
+	cleanup := func() {
+		for _, j := range batch {
+			j.Cleanup()
+		}
+	}
+
+	for i, jr := range requests {
+		jr.owner = t.Name
+		j, err := jr.newJob(c)
+		if err != nil {
+			cleanup()
+			sendJobRequestError(r, batchItemError(i, err))
+			return
+		}
+		batch = append(batch, j)
+	}
+
+	id := jobs.nextBatch()
+	for _, j := range batch {
+		j.batch = id
+	}
+
+	if c.noop {
+		for _, j := range batch {
+			jobs.Add(j)
+		}
+	} else if err := jobs.SubmitBatch(batch); err != nil {
+		cleanup()
+		if err == errQueueFull {
+			sendErrors(r, 429, "queue_full", err.Error())
+			return
+		}
+		sendJobRequestError(r, err)
+		return
+	}
+
+	res.Header().Set("Location", jobs.batchHref(id))
+	jr := newJobResponse(batch, fieldsMapFromRequest(req, c))
+	jr.Batch = id
+	r.JSON(201, jr)
+}
+
+// signalBatch sends a signal to every job in a batch that isn't done yet,
+// cancelling those that haven't started.  Like signalJob, the jobs are
+// stopped with TERM and then KILL unless told otherwise.
+func signalBatch(r render.Render, req *http.Request, params martini.Params,
+	c *serverContext, t *apiToken) {
+
+	batch, err := strconv.Atoi(params["batch"])
+	if err != nil {
+		sendInvalidParam400(r, "batch", params["batch"])
+		return
+	}
+
+	sig, ok := signalParam(r, req.URL.Query().Get("signal"))
+	if !ok {
+		return
+	}
+
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	selected := t.visibleJobs(jobs.Batch(batch))
+	if len(selected) == 0 {
+		sendErrors(r, 404, "no_such_batch", fmt.Sprintf("no batch %v", batch))
+		return
+	}
+
+	for _, j := range selected {
+		err := signalOrStop(jobs, j.id, sig)
+		if err != nil && err != errJobDone && err != errJobNotRunning {
+			send500(r, err)
+			return
+		}
+	}
+
+	resp := newJobResponse(selected, fieldsMapFromRequest(req, c))
+	resp.Batch = batch
+	r.JSON(200, resp)
+}
+
+// signalParam looks up the named signal, sending a 400 if there's no
+// such signal.  No name at all gives a zero signal, meaning to stop jobs
+// with TERM and then KILL.
+func signalParam(r render.Render, name string) (syscall.Signal, bool) {
+	if name == "" {
+		return 0, true
+	}
+
+	sig, ok := signalFromName(name)
+	if !ok {
+		sendInvalidParam400(r, "signal", name)
+	}
+	return sig, ok
+}
+
+// signalOrStop sends sig to a job, or stops it when sig is zero
+func signalOrStop(g *jobGroup, i int, sig syscall.Signal) error {
+	if sig == 0 {
+		return g.Stop(i)
+	}
+	return g.Signal(i, sig)
+}
+
+func allCommands(r render.Render, c *serverContext) {
+	r.JSON(200, &commandResponse{Commands: c.commands.All()})
+}
+
+func getCommand(r render.Render, params martini.Params, c *serverContext) {
+	cmd := c.commands.Get(params["command"])
+	if cmd == nil {
+		sendErrors(r, 404, "no_such_command", fmt.Sprintf("no command %q", params["command"]))
+		return
+	}
+
+	r.JSON(200, &commandResponse{Commands: []*command{cmd}})
+}
+
+func delAllJobs(r render.Render, req *http.Request, params martini.Params,
+	c *serverContext, t *apiToken) {
+
+	batch, ok := batchParam(r, req)
+	if !ok {
+		return
+	}
+
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	for _, job := range t.visibleJobs(jobs.Getall(req.URL.Query().Get("state"))) {
+		if batch != 0 && job.batch != batch {
+			continue
+		}
+		if !c.noop {
+			jobs.Kill(job.id)
+		}
+		jobs.Remove(job.id)
+	}
+
+	r.JSON(204, "")
+}
+
+// allJobs lists the jobs in the group, optionally only those with the
+// given ids, batch and/or state.  When asked to wait, it waits for all of them
+// to be done and answers with a 202 if some still aren't.
+func allJobs(r render.Render, req *http.Request, params martini.Params,
+	c *serverContext, t *apiToken) {
+
+	batch, ok := batchParam(r, req)
+	if !ok {
+		return
+	}
+
+	ids := map[int]bool{}
+	if idString := req.URL.Query().Get("id"); idString != "" {
+		for _, part := range strings.Split(idString, ",") {
+			i, err := strconv.Atoi(part)
+			if err != nil {
+				sendInvalidJob400(r, part)
+				return
+			}
+			ids[i] = true
+		}
+	}
+
+	wait, ok := waitParam(r, req)
+	if !ok {
+		return
+	}
+
+	jobs, ok := getJobGroupOr404(r, params, c)
+	if !ok {
+		return
+	}
+
+	selected := []*job{}
+	for _, j := range t.visibleJobs(jobs.Getall(req.URL.Query().Get("state"))) {
+		if (len(ids) == 0 || ids[j.id]) && (batch == 0 || j.batch == batch) {
+			selected = append(selected, j)
+		}
+	}
+
+	fields := fieldsMapFromRequest(req, c)
+	if wait == 0 {
+		r.JSON(200, newJobResponse(selected, fields))
+		return
+	}
+
+	waitForJobs(req, selected, wait)
+	for _, j := range selected {
+		if !j.isDone() {
+			r.JSON(202, newJobResponse(selected, fields))
+			return
+		}
+	}
+	r.JSON(200, newJobResponse(selected, fields))
+}
+
+// batchParam is the batch a request asked for jobs from, or 0 for jobs
+// from any batch or none
+func batchParam(r render.Render, req *http.Request) (int, bool) {
+	batchString := req.URL.Query().Get("batch")
+	if batchString == "" {
+		return 0, true
+	}
+
+	batch, err := strconv.Atoi(batchString)
+	if err != nil || batch < 1 {
+		sendInvalidParam400(r, "batch", batchString)
+		return 0, false
+	}
+	return batch, true
+}
+
+// waitParam is how long a request asked to wait for jobs to be done,
+// which is not at all without a wait query parameter
+func waitParam(r render.Render, req *http.Request) (time.Duration, bool) {
+	waitString := req.URL.Query().Get("wait")
+	if waitString == "" {
+		return 0, true
+	}
+
+	wait, err := time.ParseDuration(waitString)
+	if err != nil || wait < 0 {
+		sendInvalidParam400(r, "wait", waitString)
+		return 0, false
+	}
+	return wait, true
+}
+
+// waitForJobs blocks until every job is done, the wait is up, or the
+// client goes away
+func waitForJobs(req *http.Request, jobs []*job, wait time.Duration) {
+	if wait <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for _, j := range jobs {
+		select {
+		case <-j.Done():
+		case <-timer.C:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func send500(r render.Render, err error) {
+	r.JSON(500, map[string]string{
+		"error": fmt.Sprintf("nope. %v", err),
+	})
+	return
+}
+
+func sendInvalidJob400(r render.Render, i string) {
+	r.JSON(400, map[string]string{
+		"error":   "invalid job number",
+		"message": fmt.Sprintf("what is %q?", i),
+	})
+	return
+}
+
+func sendInvalidParam400(r render.Render, name, value string) {
+	r.JSON(400, map[string]string{
+		"error":   fmt.Sprintf("invalid %v", name),
+		"message": fmt.Sprintf("what is %q?", value),
+	})
+}
+
+// sendJobRequestError is a 400 for invalid job requests, a 403 for
+// forbidden ones and a 500 for everything else
+func sendJobRequestError(r render.Render, err error) {
+	switch e := err.(type) {
+	case *jobRequestError:
+		sendInvalidParam400(r, e.name, e.value)
+	case *jobForbiddenError:
+		sendErrors(r, 403, "forbidden", e.message)
+	default:
+		send500(r, err)
+	}
+}
+
+func sendErrors(r render.Render, status int, code, message string) {
+	r.JSON(status, &errorsResponse{
+		Errors: []*errorsResponseItem{
+			&errorsResponseItem{
+				Message: message,
+				Code:    code,
+			},
+		},
+	})
+}
+
+func getMainJobGroupOr500(r render.Render) (*jobGroup, bool) {
+	jobs := GetJobGroup("main")
+	if jobs == nil {
+		sendErrors(r, 500, "0", "missing main job group")
+		return nil, false
+	}
+	return jobs, true
+}
+
+// getJobGroupOr404 finds the job group named in the route, defaulting to
+// "main" for routes without one
+func getJobGroupOr404(r render.Render, params martini.Params, c *serverContext) (*jobGroup, bool) {
+	name, ok := params["name"]
+	if !ok {
+		return getMainJobGroupOr500(r)
+	}
+
+	jobs := GetJobGroup(name)
+	if jobs == nil {
+		r.JSON(404, c.noSuchGroup)
+		return nil, false
+	}
+	return jobs, true
+}
+
+func fieldsMapFromRequest(req *http.Request, c *serverContext) *map[string]int {
+	fieldsSlice, ok := req.URL.Query()["fields"]
+	if !ok {
+		fieldsSlice = []string{c.defaultJobFields}
+	}
+	return fieldsMapFromString(fieldsSlice[0])
+}
+
+func fieldsMapFromString(f string) *map[string]int {
+	fields := &map[string]int{}
+	for _, part := range strings.Split(f, ",") {
+		(*fields)[part] = 1
+	}
+	return fields
+}
+
+// reloadOnHUP rereads the token file and command catalog whenever the
+// server gets SIGHUP
+func reloadOnHUP(c *serverContext) {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
+	for range hups {
+		if c.tokensFile != "" {
+			err := c.tokens.Reload()
+			if err != nil {
+				c.logger.WithField("err", err).Warn("Failed to reload tokens")
+			} else {
+				c.logger.WithField("tokens", c.tokensFile).Info("Reloaded tokens")
+			}
+		}
+
+		if c.commandsDir != "" {
+			err := c.commands.Reload()
+			if err != nil {
+				c.logger.WithField("err", err).Warn("Failed to reload commands")
+			} else {
+				c.logger.WithField("commands", c.commandsDir).Info("Reloaded commands")
+			}
+		}
+	}
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+func envInt(key string, def int) int {
+	i, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return i
 }
 
 func makeSecret() string {
@@ -1,13 +1,16 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"strings"
 	"testing"
 	"time"
@@ -31,6 +34,7 @@ var (
 		notAuthorized: defaultNotAuthorized,
 		rootMap:       defaultRootMap,
 		noSuchJob:     defaultNoSuchJob,
+		noSuchGroup:   defaultNoSuchGroup,
 		secret:        "swordfish",
 
 		fl:   flag.NewFlagSet("rtot-test", flag.ContinueOnError),
@@ -124,6 +128,34 @@ func TestServerCreateJob(t *testing.T) {
 	}
 }
 
+func TestServerCreateJobRejectsBadTimeout(t *testing.T) {
+	resp := getResponse("POST", "/jobs?timeout=soon", "application/octet-stream",
+		strings.NewReader("echo never"), true)
+	if resp.Code != 400 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerCreateJobForbidsUnlistedUser(t *testing.T) {
+	req, err := http.NewRequest("POST", "/jobs", strings.NewReader("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "rtot "+testServerContext.secret)
+	req.Header.Set("Rtot-User", "root")
+
+	hr, m := setupServer()
+	m.ServeHTTP(hr, req)
+	if hr.Code != 403 {
+		testDumpFail(t, hr)
+	}
+
+	dest := &errorsResponse{}
+	if err := json.Unmarshal(hr.Body.Bytes(), dest); err != nil || len(dest.Errors) != 1 {
+		t.Errorf("expected an errors response, got %q", hr.Body.String())
+	}
+}
+
 func TestServerGetAllJobs(t *testing.T) {
 	createTestJob(t, "echo another thing")
 	resp := getResponse("GET", "/jobs", "", nil, true)
@@ -150,7 +182,7 @@ func TestServerDeleteAllJobs(t *testing.T) {
 
 func TestServerDeleteJobByID(t *testing.T) {
 	out := createTestJob(t, "echo chamber")
-	dest := &jobResponse{}
+	dest := &JobResponse{}
 	err := json.Unmarshal([]byte(out), &dest)
 	if err != nil {
 		t.Error(err)
@@ -167,3 +199,582 @@ func TestServerDeleteJobByID(t *testing.T) {
 		}
 	}
 }
+
+func runTestJob(t *testing.T, script string) *job {
+	jobs := GetJobGroup("main")
+	if jobs == nil {
+		t.Fatal("missing main job group")
+	}
+
+	j, err := newJob(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs.Add(j)
+	j.Run()
+	return j
+}
+
+// startTestJob adds a job to the main group and runs it in the
+// background
+func startTestJob(t *testing.T, script string) *job {
+	jobs := GetJobGroup("main")
+	if jobs == nil {
+		t.Fatal("missing main job group")
+	}
+
+	j, err := newJob(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs.Add(j)
+	go j.Run()
+	return j
+}
+
+func TestServerWaitsForJob(t *testing.T) {
+	j := startTestJob(t, "sleep 0.1 ; echo waited")
+	resp := getResponse("GET", fmt.Sprintf("/jobs/%v?wait=10s&fields=out", j.id), "", nil, true)
+	if resp.Code != 200 {
+		testDumpFail(t, resp)
+	}
+
+	dest := &JobResponse{}
+	json.Unmarshal(resp.Body.Bytes(), dest)
+	if len(dest.Jobs) != 1 || dest.Jobs[0].Out != "waited\n" {
+		t.Errorf("unexpected response %v", resp.Body.String())
+	}
+}
+
+func TestServerWaitForJobTimesOut(t *testing.T) {
+	created := &JobResponse{}
+	json.Unmarshal([]byte(createTestJob(t, "echo never run")), created)
+	href := created.Jobs[0].Href
+
+	resp := getResponse("GET", href+"?wait=10ms", "", nil, true)
+	if resp.Code != 202 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getResponse("GET", href+"?wait=wat", "", nil, true)
+	if resp.Code != 400 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerWaitsForSeveralJobs(t *testing.T) {
+	first := startTestJob(t, "sleep 0.1")
+	second := startTestJob(t, "sleep 0.2")
+
+	resp := getResponse("GET", fmt.Sprintf("/jobs?id=%v,%v&wait=10s", first.id, second.id),
+		"", nil, true)
+	if resp.Code != 200 {
+		testDumpFail(t, resp)
+	}
+
+	dest := &JobResponse{}
+	json.Unmarshal(resp.Body.Bytes(), dest)
+	if len(dest.Jobs) != 2 {
+		t.Fatalf("unexpected response %v", resp.Body.String())
+	}
+	for _, j := range dest.Jobs {
+		if j.State != "complete" {
+			t.Errorf("expected job %v to be complete, got %v", j.ID, j.State)
+		}
+	}
+}
+
+func TestServerSignalCancelsUnstartedJob(t *testing.T) {
+	created := &JobResponse{}
+	json.Unmarshal([]byte(createTestJob(t, "echo never run")), created)
+	href := created.Jobs[0].Href
+
+	resp := getResponse("POST", href+"/signal?signal=int", "", nil, true)
+	if resp.Code != 200 {
+		testDumpFail(t, resp)
+	}
+
+	dest := &JobResponse{}
+	json.Unmarshal(resp.Body.Bytes(), dest)
+	if len(dest.Jobs) != 1 || dest.Jobs[0].State != "killed" || dest.Jobs[0].KillSignal != "SIGINT" {
+		t.Errorf("unexpected response %v", resp.Body.String())
+	}
+
+	resp = getResponse("POST", href+"/signal", "application/json",
+		strings.NewReader(`{"signal": "KILL"}`), true)
+	if resp.Code != 409 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getResponse("GET", href, "", nil, true)
+	if resp.Code != 200 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerSignalRejectsUnknownSignals(t *testing.T) {
+	created := &JobResponse{}
+	json.Unmarshal([]byte(createTestJob(t, "echo never run")), created)
+
+	resp := getResponse("POST", created.Jobs[0].Href+"/signal?signal=WAT", "", nil, true)
+	if resp.Code != 400 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerWritesJobStdin(t *testing.T) {
+	j, err := newJob("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.openStdin([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	GetJobGroup("main").Add(j)
+	resp := getResponse("POST", j.Href()+"/stdin", "", strings.NewReader("too soon\n"), true)
+	if resp.Code != 409 {
+		testDumpFail(t, resp)
+	}
+
+	go j.Run()
+	for !j.hasStarted() {
+		time.Sleep(time.Millisecond)
+	}
+
+	resp = getResponse("POST", j.Href()+"/stdin?close=true", "", strings.NewReader("second\n"), true)
+	if resp.Code != 204 {
+		testDumpFail(t, resp)
+	}
+
+	select {
+	case <-j.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("job never saw the end of stdin")
+	}
+
+	if j.outBuf.String() != "first\nsecond\n" {
+		t.Errorf("unexpected output %q", j.outBuf.String())
+	}
+
+	resp = getResponse("POST", j.Href()+"/stdin", "", strings.NewReader("too late\n"), true)
+	if resp.Code != 409 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerStreamsJobOutput(t *testing.T) {
+	j := runTestJob(t, "echo streamed ; echo oops >&2")
+	resp := getResponse("GET", fmt.Sprintf("/jobs/%v/out", j.id), "", nil, true)
+	if resp.Code != 200 {
+		testDumpFail(t, resp)
+	}
+
+	if resp.Body.String() != "streamed\n" {
+		t.Errorf("unexpected output %q", resp.Body.String())
+	}
+
+	resp = getResponse("GET", fmt.Sprintf("/jobs/%v/log", j.id), "", nil, true)
+	if len(resp.Body.String()) != len("streamed\noops\n") ||
+		!strings.Contains(resp.Body.String(), "oops\n") {
+		t.Errorf("unexpected log %q", resp.Body.String())
+	}
+}
+
+func TestServerStreamsJobOutputFromOffset(t *testing.T) {
+	j := runTestJob(t, "echo streamed")
+	resp := getResponse("GET", fmt.Sprintf("/jobs/%v/out?offset=3", j.id), "", nil, true)
+	if resp.Body.String() != "eamed\n" {
+		t.Errorf("unexpected output %q", resp.Body.String())
+	}
+}
+
+func TestServerStreamJobOutputRejectsBadOffset(t *testing.T) {
+	j := runTestJob(t, "echo streamed")
+	resp := getResponse("GET", fmt.Sprintf("/jobs/%v/out?offset=wat", j.id), "", nil, true)
+	if resp.Code != 400 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerStreamsEvents(t *testing.T) {
+	server := httptest.NewServer(NewServer(testServerContext))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/events?state=complete", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "rtot "+testServerContext.secret)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	j := runTestJob(t, "echo eventful")
+
+	lines := bufio.NewReader(resp.Body)
+	for _, prefix := range []string{"id: ", "event: completed", "data: "} {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, prefix) {
+			t.Errorf("expected %q to start with %q", line, prefix)
+		}
+		if prefix == "data: " && !strings.Contains(line, fmt.Sprintf(`"job_id":%v`, j.id)) {
+			t.Errorf("expected event for job %v, got %q", j.id, line)
+		}
+	}
+}
+
+func TestServerCreatesJobGroups(t *testing.T) {
+	resp := getResponse("POST", "/groups", "application/json",
+		strings.NewReader(`{"name":"team-a","max_concurrent":2}`), true)
+	if resp.Code != 201 {
+		testDumpFail(t, resp)
+	}
+
+	if resp.Header().Get("Location") != "/groups/team-a" {
+		t.Errorf("unexpected location %q", resp.Header().Get("Location"))
+	}
+
+	resp = getResponse("POST", "/groups", "application/json",
+		strings.NewReader(`{"name":"team-a"}`), true)
+	if resp.Code != 409 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getResponse("GET", "/groups", "", nil, true)
+	dest := &jobGroupResponse{}
+	if err := json.Unmarshal(resp.Body.Bytes(), dest); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, g := range dest.Groups {
+		if g.Name == "team-a" && g.MaxConcurrent == 2 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected team-a in %v", resp.Body.String())
+	}
+}
+
+func TestServerRejectsInvalidJobGroups(t *testing.T) {
+	for _, body := range []string{
+		`{"name":"../etc"}`,
+		`{"name":"..","store":"disk"}`,
+		`{"name":".","store":"disk"}`,
+		`{"name":".hidden"}`,
+		`{"name":"x","store":"wat"}`,
+		`nope`,
+	} {
+		resp := getResponse("POST", "/groups", "application/json",
+			strings.NewReader(body), true)
+		if resp.Code != 400 {
+			testDumpFail(t, resp)
+		}
+	}
+}
+
+func TestServerScopesJobsToGroups(t *testing.T) {
+	getResponse("POST", "/groups", "application/json",
+		strings.NewReader(`{"name":"team-b"}`), true)
+
+	resp := getResponse("POST", "/groups/team-b/jobs", "application/octet-stream",
+		strings.NewReader("echo grouped"), true)
+	if resp.Code != 201 {
+		testDumpFail(t, resp)
+	}
+
+	dest := &JobResponse{}
+	if err := json.Unmarshal(resp.Body.Bytes(), dest); err != nil {
+		t.Fatal(err)
+	}
+
+	href := dest.Jobs[0].Href
+	if !strings.HasPrefix(href, "/groups/team-b/jobs/") {
+		t.Errorf("unexpected href %q", href)
+	}
+
+	resp = getResponse("GET", href, "", nil, true)
+	if resp.Code != 202 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getResponse("GET", "/groups/nope/jobs", "", nil, true)
+	if resp.Code != 404 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getResponse("DELETE", "/groups/team-b", "", nil, true)
+	if resp.Code != 204 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getResponse("GET", href, "", nil, true)
+	if resp.Code != 404 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerRefusesToDeleteMainGroup(t *testing.T) {
+	resp := getResponse("DELETE", "/groups/main", "", nil, true)
+	if resp.Code != 400 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerReturnsJobOutputRanges(t *testing.T) {
+	j := runTestJob(t, "echo 0123456789")
+	resp := getResponse("GET", fmt.Sprintf("/jobs/%v?fields=out&offset=2&limit=3", j.id), "", nil, true)
+	if resp.Code != 200 {
+		testDumpFail(t, resp)
+	}
+
+	dest := &JobResponse{}
+	json.Unmarshal(resp.Body.Bytes(), dest)
+	if len(dest.Jobs) != 1 || dest.Jobs[0].Out != "234" || dest.Jobs[0].OutBytes != 11 {
+		t.Errorf("unexpected response %v", resp.Body.String())
+	}
+
+	resp = getResponse("GET", fmt.Sprintf("/jobs/%v?limit=-1", j.id), "", nil, true)
+	if resp.Code != 400 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerStreamsJobLogAsNDJSON(t *testing.T) {
+	jobs := GetJobGroup("main")
+	j, err := newJob("echo streamed ; echo oops >&2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.recordLog()
+	jobs.Add(j)
+	j.Run()
+
+	resp := getResponse("GET", fmt.Sprintf("/jobs/%v/log.ndjson", j.id), "", nil, true)
+	if resp.Code != 200 || resp.Header().Get("Content-Type") != "application/x-ndjson" {
+		testDumpFail(t, resp)
+	}
+
+	lines := strings.Split(strings.TrimSpace(resp.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected log %q", resp.Body.String())
+	}
+	e := &LogEntry{}
+	if err := json.Unmarshal([]byte(lines[0]), e); err != nil || e.Stream == "" || e.Time.IsZero() {
+		t.Errorf("unexpected entry %q", lines[0])
+	}
+
+	resp = getResponse("GET", fmt.Sprintf("/jobs/%v?fields=log", j.id), "", nil, true)
+	dest := &JobResponse{}
+	json.Unmarshal(resp.Body.Bytes(), dest)
+	if len(dest.Jobs) != 1 || len(dest.Jobs[0].Log) != 2 {
+		t.Errorf("unexpected response %v", resp.Body.String())
+	}
+}
+
+func TestServerJobLogRequiresRecording(t *testing.T) {
+	j := runTestJob(t, "echo unlogged")
+	resp := getResponse("GET", fmt.Sprintf("/jobs/%v/log.ndjson", j.id), "", nil, true)
+	if resp.Code != 404 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerCreatesSchedules(t *testing.T) {
+	GetJobGroup("main").StartScheduler(testServerContext)
+
+	resp := getResponse("POST", "/schedules", "application/json",
+		strings.NewReader(`{"cron": "0 3 * * *", "overlap": "queue", "script": "echo nightly"}`), true)
+	if resp.Code != 201 {
+		testDumpFail(t, resp)
+	}
+
+	dest := &ScheduleResponse{}
+	json.Unmarshal(resp.Body.Bytes(), dest)
+	if len(dest.Schedules) != 1 || dest.Schedules[0].NextRun == "" ||
+		dest.Schedules[0].Overlap != "queue" {
+		t.Fatalf("unexpected response %v", resp.Body.String())
+	}
+
+	href := resp.Header().Get("Location")
+	resp = getResponse("GET", href, "", nil, true)
+	if resp.Code != 200 || !strings.Contains(resp.Body.String(), "echo nightly") {
+		testDumpFail(t, resp)
+	}
+
+	resp = getResponse("DELETE", href, "", nil, true)
+	if resp.Code != 204 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getResponse("GET", href, "", nil, true)
+	if resp.Code != 404 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerRejectsInvalidSchedules(t *testing.T) {
+	GetJobGroup("main").StartScheduler(testServerContext)
+
+	for _, body := range []string{
+		`{"script": "echo never"}`,
+		`{"cron": "61 * * * *", "script": "echo never"}`,
+		`{"every": "1h", "overlap": "sometimes", "script": "echo never"}`,
+		`{"every": "1h", "dir": "/nonexistent", "script": "echo never"}`,
+	} {
+		resp := getResponse("POST", "/schedules", "application/json", strings.NewReader(body), true)
+		if resp.Code != 400 {
+			testDumpFail(t, resp)
+		}
+	}
+}
+
+func TestServerParsesJobRunTimes(t *testing.T) {
+	resp := getResponse("POST", "/jobs?delay=1h", "application/octet-stream",
+		strings.NewReader("echo later"), true)
+	if resp.Code != 201 || !strings.Contains(resp.Body.String(), `"run_at"`) {
+		testDumpFail(t, resp)
+	}
+
+	for _, query := range []string{"delay=soon", "run_at=tomorrow", "delay=1h&run_at=2030-01-01T00:00:00Z"} {
+		resp = getResponse("POST", "/jobs?"+query, "application/octet-stream",
+			strings.NewReader("echo never"), true)
+		if resp.Code != 400 {
+			testDumpFail(t, resp)
+		}
+	}
+}
+
+func TestServerReschedulesJobs(t *testing.T) {
+	jobs := GetJobGroup("main")
+	j, err := newJob("echo later")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.setRunAt(time.Now().Add(time.Hour))
+	jobs.Submit(j)
+	defer jobs.Kill(j.id)
+
+	resp := getResponse("POST", j.Href()+"/reschedule?run_at=2030-01-01T00:00:00Z", "", nil, true)
+	if resp.Code != 200 || !strings.Contains(resp.Body.String(), "2030-01-01") {
+		testDumpFail(t, resp)
+	}
+
+	done := runTestJob(t, "echo done")
+	resp = getResponse("POST", done.Href()+"/reschedule", "application/json",
+		strings.NewReader(`{"delay": "0s"}`), true)
+	if resp.Code != 409 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerReturnsJobGraphs(t *testing.T) {
+	first := runTestJob(t, "echo first")
+	resp := getResponse("POST", fmt.Sprintf("/jobs?after=%v", first.id), "application/octet-stream",
+		strings.NewReader("echo second"), true)
+	if resp.Code != 201 {
+		testDumpFail(t, resp)
+	}
+	created := &JobResponse{}
+	json.Unmarshal(resp.Body.Bytes(), created)
+	if len(created.Jobs) != 1 || len(created.Jobs[0].After) != 1 {
+		t.Fatalf("unexpected response %v", resp.Body.String())
+	}
+	second := created.Jobs[0]
+
+	resp = getResponse("GET", fmt.Sprintf("/jobs/%v/graph", first.id), "", nil, true)
+	if resp.Code != 200 {
+		testDumpFail(t, resp)
+	}
+
+	dest := &GraphResponse{}
+	json.Unmarshal(resp.Body.Bytes(), dest)
+	if len(dest.Jobs) != 2 || len(dest.Edges) != 1 ||
+		dest.Edges[0].From != first.id || dest.Edges[0].To != second.ID {
+		t.Errorf("unexpected graph %v", resp.Body.String())
+	}
+
+	resp = getResponse("POST", "/jobs?after=99999", "application/octet-stream",
+		strings.NewReader("echo never"), true)
+	if resp.Code != 400 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerCreatesBatches(t *testing.T) {
+	resp := getResponse("POST", "/jobs/batch", "application/json",
+		strings.NewReader(`[{"script": "echo one"}, {"script": "echo two", "priority": 5}]`), true)
+	if resp.Code != 201 {
+		testDumpFail(t, resp)
+	}
+
+	created := &JobResponse{}
+	json.Unmarshal(resp.Body.Bytes(), created)
+	if len(created.Jobs) != 2 || created.Batch == 0 || created.Jobs[1].Batch != created.Batch ||
+		created.Jobs[1].Priority != 5 {
+		t.Fatalf("unexpected response %v", resp.Body.String())
+	}
+
+	resp = getResponse("GET", resp.Header().Get("Location"), "", nil, true)
+	listed := &JobResponse{}
+	json.Unmarshal(resp.Body.Bytes(), listed)
+	if len(listed.Jobs) != 2 {
+		t.Errorf("expected 2 jobs in the batch, got %v", resp.Body.String())
+	}
+
+	resp = getResponse("POST", fmt.Sprintf("/jobs/batch/%v/signal", created.Batch), "", nil, true)
+	if resp.Code != 200 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerCreatesBatchesFromMultipart(t *testing.T) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	part, _ := mw.CreateFormFile("script", "one.sh")
+	part.Write([]byte("echo one"))
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "application/json")
+	part, _ = mw.CreatePart(header)
+	part.Write([]byte(`{"script": "echo two", "timeout": "1m"}`))
+	mw.Close()
+
+	resp := getResponse("POST", "/jobs/batch", mw.FormDataContentType(), body, true)
+	if resp.Code != 201 {
+		testDumpFail(t, resp)
+	}
+
+	created := &JobResponse{}
+	json.Unmarshal(resp.Body.Bytes(), created)
+	if len(created.Jobs) != 2 || created.Jobs[1].Timeout != "1m0s" {
+		t.Errorf("unexpected response %v", resp.Body.String())
+	}
+}
+
+func TestServerRejectsInvalidBatches(t *testing.T) {
+	before := len(GetJobGroup("main").Getall(""))
+
+	resp := getResponse("POST", "/jobs/batch", "application/json",
+		strings.NewReader(`[{"script": "echo fine"}, {"script": "echo bad", "timeout": "never"}]`), true)
+	if resp.Code != 400 || !strings.Contains(resp.Body.String(), "jobs[1].timeout") {
+		testDumpFail(t, resp)
+	}
+
+	if after := len(GetJobGroup("main").Getall("")); after != before {
+		t.Errorf("expected no jobs to be created, went from %v to %v", before, after)
+	}
+}
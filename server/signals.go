@@ -0,0 +1,52 @@
+package server
+
+import (
+	"strings"
+	"syscall"
+)
+
+var signalsByName = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"ABRT": syscall.SIGABRT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"SEGV": syscall.SIGSEGV,
+	"USR2": syscall.SIGUSR2,
+	"PIPE": syscall.SIGPIPE,
+	"ALRM": syscall.SIGALRM,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+	"TSTP": syscall.SIGTSTP,
+}
+
+// terminatingSignals are the ones sent to end a job, as opposed to ones
+// like HUP, STOP or CONT that a job is expected to carry on after
+var terminatingSignals = map[syscall.Signal]bool{
+	syscall.SIGINT:  true,
+	syscall.SIGQUIT: true,
+	syscall.SIGABRT: true,
+	syscall.SIGKILL: true,
+	syscall.SIGTERM: true,
+}
+
+// signalFromName accepts signal names with or without the "SIG" prefix
+// in any case, e.g. "TERM", "sigterm" or "SIGTERM"
+func signalFromName(name string) (syscall.Signal, bool) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	sig, ok := signalsByName[name]
+	return sig, ok
+}
+
+// signalName returns e.g. "SIGTERM", falling back to the signal's
+// number for signals missing from signalsByName
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalsByName {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return "SIG" + strings.TrimPrefix(sig.String(), "signal ")
+}
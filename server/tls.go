@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// checkTLS makes sure the certificate and key are given together, and
+// that client certificate settings only come with them, as a plain HTTP
+// request never has a verified client certificate
+func (c *serverContext) checkTLS() error {
+	if c.tlsCert == "" && c.tlsKey != "" || c.tlsCert != "" && c.tlsKey == "" {
+		return fmt.Errorf("a TLS certificate and key must be given together")
+	}
+	if c.tlsCert == "" && (c.tlsClientCA != "" || c.tlsClientAuth != "either") {
+		return fmt.Errorf("client certificate settings need a TLS certificate and key")
+	}
+	return nil
+}
+
+// tlsConfig builds the TLS configuration for serving HTTPS, verifying
+// client certificates against the client CA bundle when one is given.
+// Requiring both a certificate and the secret needs that bundle, as no
+// certificate could be verified without it.
+func (c *serverContext) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	switch c.tlsClientAuth {
+	case "either":
+	case "both":
+		if c.tlsClientCA == "" {
+			return nil, fmt.Errorf("client auth mode both needs a client CA")
+		}
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client auth mode %v", c.tlsClientAuth)
+	}
+
+	if c.tlsClientCA == "" {
+		return config, nil
+	}
+
+	caBytes, err := ioutil.ReadFile(c.tlsClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no certificates found in %v", c.tlsClientCA)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = clientAuth
+	return config, nil
+}
+
+// clientSubject is the subject of the request's verified client
+// certificate, if any
+func clientSubject(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.String()
+}
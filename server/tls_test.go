@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func newTLSTestRequest(t *testing.T, header string, verified bool) *http.Request {
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header != "" {
+		req.Header.Set("Authorization", header)
+	}
+
+	req.TLS = &tls.ConnectionState{}
+	if verified {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "deployer"}}
+		req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return req
+}
+
+func TestAuthorizedWithEitherCertOrSecret(t *testing.T) {
+	c := &serverContext{secret: "swordfish", tlsClientAuth: "either"}
+	res := httptest.NewRecorder()
+
+	if c.authenticate(res, newTLSTestRequest(t, "rtot swordfish", false)) == nil {
+		t.Errorf("expected the secret alone to be enough")
+	}
+
+	if c.authenticate(res, newTLSTestRequest(t, "", true)) == nil {
+		t.Errorf("expected a verified certificate alone to be enough")
+	}
+
+	if c.authenticate(res, newTLSTestRequest(t, "rtot nope", false)) != nil {
+		t.Errorf("expected a wrong secret to be refused")
+	}
+}
+
+func TestAuthorizedWithBothCertAndSecret(t *testing.T) {
+	c := &serverContext{secret: "swordfish", tlsClientAuth: "both"}
+	res := httptest.NewRecorder()
+
+	if c.authenticate(res, newTLSTestRequest(t, "rtot swordfish", false)) != nil {
+		t.Errorf("expected the secret alone to be refused")
+	}
+
+	if c.authenticate(res, newTLSTestRequest(t, "", true)) != nil {
+		t.Errorf("expected a verified certificate alone to be refused")
+	}
+
+	if c.authenticate(res, newTLSTestRequest(t, "rtot swordfish", true)) == nil {
+		t.Errorf("expected both to be enough")
+	}
+}
+
+func TestClientSubject(t *testing.T) {
+	if s := clientSubject(newTLSTestRequest(t, "", true)); s != "CN=deployer" {
+		t.Errorf("unexpected subject %q", s)
+	}
+
+	if s := clientSubject(newTLSTestRequest(t, "", false)); s != "" {
+		t.Errorf("expected no subject, got %q", s)
+	}
+}
+
+func TestTLSConfigRejectsBadClientCA(t *testing.T) {
+	c := &serverContext{tlsClientCA: "/no/such/ca.pem", tlsClientAuth: "either"}
+	if _, err := c.tlsConfig(); err == nil {
+		t.Errorf("expected missing client CA to fail")
+	}
+
+	f, err := ioutil.TempFile("", "rtot-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	c.tlsClientCA = f.Name()
+	if _, err := c.tlsConfig(); err == nil {
+		t.Errorf("expected invalid client CA to fail")
+	}
+}
+
+func TestTLSConfigChecksClientAuthMode(t *testing.T) {
+	c := &serverContext{tlsClientAuth: "wat"}
+	if _, err := c.tlsConfig(); err == nil {
+		t.Errorf("expected invalid client auth mode to fail without a client CA")
+	}
+
+	c.tlsClientAuth = "both"
+	if _, err := c.tlsConfig(); err == nil {
+		t.Errorf("expected both without a client CA to fail")
+	}
+
+	c.tlsClientAuth = "either"
+	if _, err := c.tlsConfig(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCheckTLSNeedsCertificateAndKey(t *testing.T) {
+	for _, c := range []*serverContext{
+		{tlsCert: "cert.pem", tlsClientAuth: "either"},
+		{tlsKey: "key.pem", tlsClientAuth: "either"},
+		{tlsClientCA: "ca.pem", tlsClientAuth: "either"},
+		{tlsClientAuth: "both"},
+	} {
+		if err := c.checkTLS(); err == nil {
+			t.Errorf("expected %+v to fail", c)
+		}
+	}
+
+	for _, c := range []*serverContext{
+		{tlsClientAuth: "either"},
+		{tlsCert: "cert.pem", tlsKey: "key.pem", tlsClientCA: "ca.pem", tlsClientAuth: "both"},
+	} {
+		if err := c.checkTLS(); err != nil {
+			t.Errorf("unexpected error %v for %+v", err, c)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+var (
+	allScopes = []string{"jobs:read", "jobs:create", "jobs:delete", "server:admin"}
+
+	// adminToken is who callers using the shared secret or a verified
+	// client certificate are
+	adminToken = &apiToken{Scopes: allScopes}
+)
+
+// apiToken is a named secret allowed to do the things in its scopes.
+// Tokens only see the jobs they created plus those created by the
+// tokens named in Owners ("*" for everyone's), unless they have the
+// server:admin scope.
+type apiToken struct {
+	Name   string   `json:"name"`
+	Secret string   `json:"secret"`
+	Scopes []string `json:"scopes"`
+	Owners []string `json:"owners,omitempty"`
+}
+
+type tokenFile struct {
+	Tokens []*apiToken `json:"tokens"`
+}
+
+func (t *apiToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *apiToken) canSee(j *job) bool {
+	return t.canSeeOwner(j.owner)
+}
+
+func (t *apiToken) canSeeOwner(owner string) bool {
+	if t.hasScope("server:admin") || owner == t.Name {
+		return true
+	}
+	for _, o := range t.Owners {
+		if o == "*" || o == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleJobs filters out the jobs the token can't see
+func (t *apiToken) visibleJobs(jobs []*job) []*job {
+	visible := []*job{}
+	for _, j := range jobs {
+		if t.canSee(j) {
+			visible = append(visible, j)
+		}
+	}
+	return visible
+}
+
+// tokenStore holds the tokens loaded from a token file, keyed by
+// secret, and may be reloaded at any time
+type tokenStore struct {
+	sync.RWMutex
+	filename string
+	tokens   map[string]*apiToken
+	byName   map[string]*apiToken
+}
+
+func newTokenStore(filename string) (*tokenStore, error) {
+	ts := &tokenStore{
+		filename: filename,
+		tokens:   map[string]*apiToken{},
+		byName:   map[string]*apiToken{},
+	}
+	if filename == "" {
+		return ts, nil
+	}
+
+	err := ts.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// Reload rereads the token file, keeping the current tokens if it can't
+func (ts *tokenStore) Reload() error {
+	fileBytes, err := ioutil.ReadFile(ts.filename)
+	if err != nil {
+		return err
+	}
+
+	tf := &tokenFile{}
+	err = json.Unmarshal(fileBytes, tf)
+	if err != nil {
+		return fmt.Errorf("invalid token file %v: %v", ts.filename, err)
+	}
+
+	tokens := map[string]*apiToken{}
+	byName := map[string]*apiToken{}
+	for _, t := range tf.Tokens {
+		if t.Name == "" || t.Secret == "" {
+			return fmt.Errorf("invalid token file %v: tokens need a name and secret", ts.filename)
+		}
+		for _, scope := range t.Scopes {
+			if !adminToken.hasScope(scope) {
+				return fmt.Errorf("invalid token file %v: unknown scope %q", ts.filename, scope)
+			}
+		}
+		if _, ok := byName[t.Name]; ok {
+			return fmt.Errorf("invalid token file %v: more than one token named %q", ts.filename, t.Name)
+		}
+		if _, ok := tokens[t.Secret]; ok {
+			return fmt.Errorf("invalid token file %v: token %q shares its secret", ts.filename, t.Name)
+		}
+		tokens[t.Secret] = t
+		byName[t.Name] = t
+	}
+
+	ts.Lock()
+	defer ts.Unlock()
+
+	ts.tokens = tokens
+	ts.byName = byName
+	return nil
+}
+
+func (ts *tokenStore) Get(secret string) *apiToken {
+	ts.RLock()
+	defer ts.RUnlock()
+
+	return ts.tokens[secret]
+}
+
+func (ts *tokenStore) GetByName(name string) *apiToken {
+	ts.RLock()
+	defer ts.RUnlock()
+
+	return ts.byName[name]
+}
+
+// authenticate finds the token for a request from its Authorization
+// header and/or a verified client certificate, depending on the client
+// auth mode, or nil if the request isn't authorized.  Without a client
+// CA no certificate is ever verified, leaving just the header.  The
+// plain "rtot <secret>" scheme is refused when only signed requests are
+// allowed.
+func (c *serverContext) authenticate(res http.ResponseWriter, req *http.Request) *apiToken {
+	var token *apiToken
+
+	header := req.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(header, "rtot-hmac "):
+		token = c.authenticateHMAC(res, req, strings.TrimPrefix(header, "rtot-hmac "))
+	case c.hmacOnly:
+	case subtle.ConstantTimeCompare([]byte(header), []byte("rtot "+c.secret)) == 1:
+		token = adminToken
+	case strings.HasPrefix(header, "rtot ") && c.tokens != nil:
+		token = c.tokens.Get(strings.TrimPrefix(header, "rtot "))
+	}
+
+	certOK := req.TLS != nil && len(req.TLS.VerifiedChains) > 0
+	if c.tlsClientAuth == "both" {
+		if !certOK {
+			return nil
+		}
+		return token
+	}
+
+	if token == nil && certOK {
+		token = adminToken
+	}
+	return token
+}
+
+// requireScope builds a handler that refuses requests whose token lacks
+// the given scope
+func requireScope(scope string) martini.Handler {
+	return func(r render.Render, t *apiToken) {
+		if !t.hasScope(scope) {
+			sendErrors(r, http.StatusForbidden, "forbidden",
+				fmt.Sprintf("token %q lacks scope %v", t.Name, scope))
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testTokens = `{"tokens": [
+	{"name": "ci", "secret": "ci-secret", "scopes": ["jobs:read", "jobs:create"]},
+	{"name": "dash", "secret": "dash-secret", "scopes": ["jobs:read"], "owners": ["ci"]},
+	{"name": "nosy", "secret": "nosy-secret", "scopes": ["jobs:read"]}
+]}`
+
+func writeTestTokens(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "rtot-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func withTestTokens(t *testing.T) func() {
+	filename := writeTestTokens(t, testTokens)
+	ts, err := newTokenStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testServerContext.tokens = ts
+	return func() {
+		testServerContext.tokens = nil
+		os.Remove(filename)
+	}
+}
+
+func getTokenResponse(verb, path, token, body string) *httptest.ResponseRecorder {
+	hr, m := setupServer()
+	req, err := http.NewRequest(verb, path, strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Authorization", "rtot "+token)
+	m.ServeHTTP(hr, req)
+	return hr
+}
+
+func TestTokenStoreReload(t *testing.T) {
+	filename := writeTestTokens(t, testTokens)
+	defer os.Remove(filename)
+
+	ts, err := newTokenStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tok := ts.Get("ci-secret"); tok == nil || tok.Name != "ci" {
+		t.Errorf("expected ci token, got %v", tok)
+	}
+
+	ioutil.WriteFile(filename, []byte(`{"tokens": [{"name": "new", "secret": "new-secret"}]}`), 0600)
+	if err := ts.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ts.Get("ci-secret") != nil || ts.Get("new-secret") == nil {
+		t.Errorf("expected tokens to be replaced on reload")
+	}
+
+	ioutil.WriteFile(filename, []byte(`{"tokens": [{"name": "bad", "secret": "x", "scopes": ["jobs:everything"]}]}`), 0600)
+	if err := ts.Reload(); err == nil {
+		t.Errorf("expected unknown scope to fail")
+	}
+
+	if ts.Get("new-secret") == nil {
+		t.Errorf("expected failed reload to keep the old tokens")
+	}
+
+	for _, content := range []string{
+		`{"tokens": [{"name": "dup", "secret": "one"}, {"name": "dup", "secret": "two"}]}`,
+		`{"tokens": [{"name": "one", "secret": "dup"}, {"name": "two", "secret": "dup"}]}`,
+	} {
+		ioutil.WriteFile(filename, []byte(content), 0600)
+		if err := ts.Reload(); err == nil {
+			t.Errorf("expected duplicate tokens in %s to fail", content)
+		}
+		if ts.Get("new-secret") == nil || ts.GetByName("dup") != nil {
+			t.Errorf("expected failed reload to keep the old tokens")
+		}
+	}
+}
+
+func TestServerEnforcesTokenScopes(t *testing.T) {
+	defer withTestTokens(t)()
+
+	resp := getTokenResponse("POST", "/jobs", "dash-secret", "echo nope")
+	if resp.Code != 403 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getTokenResponse("DELETE", "/", "ci-secret", "")
+	if resp.Code != 403 {
+		testDumpFail(t, resp)
+	}
+
+	resp = getTokenResponse("GET", "/jobs", "wrong-secret", "")
+	if resp.Code != 401 {
+		testDumpFail(t, resp)
+	}
+}
+
+func TestServerLimitsJobsToOwners(t *testing.T) {
+	defer withTestTokens(t)()
+
+	resp := getTokenResponse("POST", "/jobs", "ci-secret", "echo mine")
+	if resp.Code != 201 {
+		testDumpFail(t, resp)
+	}
+
+	created := &JobResponse{}
+	if err := json.Unmarshal(resp.Body.Bytes(), created); err != nil {
+		t.Fatal(err)
+	}
+
+	j := created.Jobs[0]
+	if j.Owner != "ci" {
+		t.Errorf("expected owner ci, got %q", j.Owner)
+	}
+
+	for token, code := range map[string]int{"ci-secret": 202, "dash-secret": 202, "nosy-secret": 404} {
+		resp = getTokenResponse("GET", j.Href, token, "")
+		if resp.Code != code {
+			t.Errorf("expected %v for %v, got %v", code, token, resp.Code)
+		}
+	}
+
+	resp = getTokenResponse("GET", "/jobs", "nosy-secret", "")
+	if strings.Contains(resp.Body.String(), fmt.Sprintf(`"id":%v,`, j.ID)) {
+		t.Errorf("expected job %v to be hidden from nosy, got %v", j.ID, resp.Body.String())
+	}
+}